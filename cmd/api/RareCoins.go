@@ -2,7 +2,13 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"hash/fnv"
+	"mime"
 	"net/http"
+	"net/url"
+	"slices"
+	"strings"
 
 	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator"
@@ -30,13 +36,143 @@ func (m MockCoinModel) Delete(id int64) error {
 	return nil
 }
 
-func (app *application) showMCoinHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) createCoinHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Title          string      `json:"title"`
+		Year           int32       `json:"year"`
+		YearFrom       int32       `json:"year_from"`
+		YearTo         int32       `json:"year_to"`
+		Era            string      `json:"era"`
+		Country        string      `json:"country"`
+		Denomination   string      `json:"denomination"`
+		FaceValue      float64     `json:"face_value"`
+		Composition    string      `json:"composition"`
+		Weight         float64     `json:"weight"`
+		Diameter       float64     `json:"diameter"`
+		Mint           string      `json:"mint"`
+		Mintage        int64       `json:"mintage"`
+		CatalogueRefs  []string    `json:"catalogue_refs"`
+		Price          *data.Money `json:"price"`
+		PriceSource    string      `json:"price_source"`
+		Grade          string      `json:"grade"`
+		GradingService string      `json:"grading_service"`
+		CertNumber     string      `json:"cert_number"`
+		Designations   []string    `json:"designations"`
+		Legends        string      `json:"legends"`
+		Description    string      `json:"description"`
+		Genres         []string    `json:"genres"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	coin := &data.Coin{
+		Title:          input.Title,
+		Year:           input.Year,
+		YearFrom:       input.YearFrom,
+		YearTo:         input.YearTo,
+		Era:            input.Era,
+		Country:        input.Country,
+		Denomination:   input.Denomination,
+		FaceValue:      input.FaceValue,
+		Composition:    input.Composition,
+		Weight:         input.Weight,
+		Diameter:       input.Diameter,
+		Mint:           input.Mint,
+		Mintage:        input.Mintage,
+		CatalogueRefs:  input.CatalogueRefs,
+		Price:          input.Price,
+		PriceSource:    input.PriceSource,
+		Grade:          input.Grade,
+		GradingService: input.GradingService,
+		CertNumber:     input.CertNumber,
+		Designations:   input.Designations,
+		Legends:        input.Legends,
+		Description:    input.Description,
+		Genres:         input.Genres,
+	}
+	if coin.Price != nil && coin.PriceSource == "" {
+		coin.PriceSource = data.PriceSourceManual
+	}
+
+	v := validator.New()
+	if data.ValidateCoin(v, coin); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Coins.Insert(coin)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateCertificate):
+			v.AddError("cert_number", "a coin with this grading service and certificate number already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Include a Location header so the client knows where to find the newly created
+	// coin.
+	headers := make(http.Header)
+	headers.Set("Location", fmt.Sprintf("/v1/coins/%d", coin.ID))
+	headers.Set("ETag", etag(coin.Version))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"coin": coin}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The coinETag() helper returns the entity tag for a representation of a coin. The full
+// coin with the default includes has the plain version tag, which is what If-Match is
+// checked against; a sparse fieldset or different includes are a different
+// representation of the same version, so they're folded into the tag as well.
+//
+// The signed URLs of embedded images are left out of the tag: they're signed afresh on
+// every request, but point at the same images for as long as the version is unchanged.
+// A client whose cached URLs have expired can get new ones by requesting the coin
+// without If-None-Match.
+func coinETag(version int32, fields, includes []string) string {
+	if len(fields) == 0 && slices.Equal(includes, []string{"images"}) {
+		return etag(version)
+	}
+	// The lists are hashed rather than written out, because etagMatches() splits the
+	// If-None-Match header on commas.
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s;%s", strings.Join(fields, ","), strings.Join(includes, ","))
+	return fmt.Sprintf(`"%d-%08x"`, version, h.Sum32())
+}
+
+func (app *application) showCoinHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := app.readIDParam(r)
 	if err != nil {
 		app.notFoundResponse(w, r)
 		return
 	}
-	coin, err := app.models.Coins.Get(id)
+
+	v := validator.New()
+	qs := r.URL.Query()
+	currency := app.readString(qs, "currency", "")
+	if currency != "" {
+		v.Check(data.KnownCurrency(currency), "currency", "must use a supported ISO 4217 currency code")
+	}
+	// Only the fields listed in ?fields= are read and returned, and ?include= lists
+	// the related resources to embed. Images are embedded unless told otherwise.
+	fields := app.readCSV(qs, "fields", []string{})
+	includes := app.readIncludes(qs)
+	data.ValidateFields(v, "fields", fields, data.CoinFields)
+	data.ValidateFields(v, "include", includes, data.CoinIncludes)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	coin, err := app.models.Coins.Get(id, fields...)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -46,7 +182,44 @@ func (app *application) showMCoinHandler(w http.ResponseWriter, r *http.Request)
 		}
 		return
 	}
-	err = app.writeJSON(w, http.StatusOK, envelope{"coin": coin}, nil)
+
+	// If the client already has this representation of the coin, tell it so rather
+	// than sending it again. Converted prices depend on the latest exchange rates as well
+	// as the coin, so a response that includes them is always sent in full. The Vary:
+	// Authorization header set by the authenticate middleware is sent with both the 304
+	// and 200 responses.
+	tag := coinETag(coin.Version, fields, includes)
+	headers := make(http.Header)
+	headers.Set("ETag", tag)
+	if currency == "" && etagMatches(r.Header.Get("If-None-Match"), tag, true) {
+		w.Header().Set("ETag", tag)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	err = app.includeRelated(includes, coin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{}
+	if currency != "" {
+		snapshot, err := app.convertPrices(currency, coin)
+		if err != nil {
+			app.conversionErrorResponse(w, r, err)
+			return
+		}
+		env["exchange_rates"] = snapshot
+	}
+	objects, err := sparseCoins(fields, coin)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	env["coin"] = objects[0]
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -58,16 +231,49 @@ func (app *application) deleteCoinHandler(w http.ResponseWriter, r *http.Request
 		app.notFoundResponse(w, r)
 		return
 	}
-	err = app.models.Coins.Delete(id)
+	// If the client sent an If-Match header, only delete the coin if it's still at the
+	// version the client last saw. The version is checked again by the DELETE itself,
+	// in case the coin is changed in between.
+	var version int32
+	if match := r.Header.Get("If-Match"); match != "" {
+		coin, err := app.models.Coins.Get(id, "id")
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.notFoundResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if !etagMatches(match, etag(coin.Version), false) {
+			app.preconditionFailedResponse(w, r)
+			return
+		}
+		version = coin.Version
+	}
+	// Look up the coin's images before deleting it, because the image records are
+	// removed along with the coin but the files in blob storage aren't.
+	images, err := app.models.Images.GetAllForCoins(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.models.Coins.Delete(id, version)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
 			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
+	for _, img := range images[id] {
+		app.deleteObjects(img.Key, img.ThumbnailKey)
+	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "Coin successfully deleted"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -92,30 +298,46 @@ func (app *application) updateCoinHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	var input struct {
-		Title   *string       `json:"title"`
-		Year    *int32        `json:"year"`
-		Runtime *data.Runtime `json:"runtime"`
-		Genres  []string      `json:"genres"`
-	}
-
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
+	// If the client sent an If-Match header, check that it edited the current version
+	// of the coin. Update() checks the version again when it writes the changes, and if
+	// the coin has been changed in the meantime that's also a failed precondition.
+	match := r.Header.Get("If-Match")
+	if match != "" && !etagMatches(match, etag(coin.Version), false) {
+		app.preconditionFailedResponse(w, r)
 		return
 	}
 
-	if input.Title != nil {
-		coin.Title = *input.Title
-	}
-	if input.Year != nil {
-		coin.Year = *input.Year
-	}
-	if input.Runtime != nil {
-		coin.Runtime = int32(*input.Runtime)
+	// As well as a plain JSON object of the fields to change, the request body can be a
+	// JSON Merge Patch (which can also clear optional fields by setting them to null) or
+	// a JSON Patch (which can also make changes inside arrays, like adding one genre).
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			app.unsupportedMediaTypeResponse(w, r)
+			return
+		}
 	}
-	if input.Genres != nil {
-		coin.Genres = input.Genres
+	switch mediaType {
+	case "application/json":
+		err = app.readCoinUpdate(w, r, coin)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	case mergePatchType, jsonPatchType:
+		patchErrors, err := app.readCoinPatch(w, r, coin, mediaType)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+		if patchErrors != nil {
+			app.failedValidationResponse(w, r, patchErrors)
+			return
+		}
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
 	}
 
 	v := validator.New()
@@ -127,6 +349,11 @@ func (app *application) updateCoinHandler(w http.ResponseWriter, r *http.Request
 	err = app.models.Coins.Update(coin)
 	if err != nil {
 		switch {
+		case errors.Is(err, data.ErrDuplicateCertificate):
+			v.AddError("cert_number", "a coin with this grading service and certificate number already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict) && match != "":
+			app.preconditionFailedResponse(w, r)
 		case errors.Is(err, data.ErrEditConflict):
 			app.editConflictResponse(w, r)
 		default:
@@ -135,40 +362,264 @@ func (app *application) updateCoinHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"coin": coin}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(coin.Version))
+	err = app.writeJSON(w, http.StatusOK, envelope{"coin": coin}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 }
 
+// coinUpdate holds the fields of a plain JSON update to a coin. Fields that the client
+// left out are nil, and are left unchanged by applyTo.
+type coinUpdate struct {
+	Title          *string     `json:"title"`
+	Year           *int32      `json:"year"`
+	YearFrom       *int32      `json:"year_from"`
+	YearTo         *int32      `json:"year_to"`
+	Era            *string     `json:"era"`
+	Country        *string     `json:"country"`
+	Denomination   *string     `json:"denomination"`
+	FaceValue      *float64    `json:"face_value"`
+	Composition    *string     `json:"composition"`
+	Weight         *float64    `json:"weight"`
+	Diameter       *float64    `json:"diameter"`
+	Mint           *string     `json:"mint"`
+	Mintage        *int64      `json:"mintage"`
+	CatalogueRefs  []string    `json:"catalogue_refs"`
+	Price          *data.Money `json:"price"`
+	PriceSource    *string     `json:"price_source"`
+	Grade          *string     `json:"grade"`
+	GradingService *string     `json:"grading_service"`
+	CertNumber     *string     `json:"cert_number"`
+	Designations   []string    `json:"designations"`
+	Legends        *string     `json:"legends"`
+	Description    *string     `json:"description"`
+	Genres         []string    `json:"genres"`
+}
+
+// applyTo copies the fields that were provided into the coin.
+func (u coinUpdate) applyTo(coin *data.Coin) {
+	if u.Title != nil {
+		coin.Title = *u.Title
+	}
+	if u.Year != nil {
+		coin.Year = *u.Year
+	}
+	if u.YearFrom != nil {
+		coin.YearFrom = *u.YearFrom
+	}
+	if u.YearTo != nil {
+		coin.YearTo = *u.YearTo
+	}
+	if u.Era != nil {
+		coin.Era = *u.Era
+	}
+	if u.Country != nil {
+		coin.Country = *u.Country
+	}
+	if u.Denomination != nil {
+		coin.Denomination = *u.Denomination
+	}
+	if u.FaceValue != nil {
+		coin.FaceValue = *u.FaceValue
+	}
+	if u.Composition != nil {
+		coin.Composition = *u.Composition
+	}
+	if u.Weight != nil {
+		coin.Weight = *u.Weight
+	}
+	if u.Diameter != nil {
+		coin.Diameter = *u.Diameter
+	}
+	if u.Mint != nil {
+		coin.Mint = *u.Mint
+	}
+	if u.Mintage != nil {
+		coin.Mintage = *u.Mintage
+	}
+	if u.CatalogueRefs != nil {
+		coin.CatalogueRefs = u.CatalogueRefs
+	}
+	// A new price is assumed to be a manual valuation unless the client says where it
+	// came from, rather than inheriting the source of the previous price.
+	if u.Price != nil {
+		coin.Price = u.Price
+		coin.PriceSource = data.PriceSourceManual
+	}
+	if u.PriceSource != nil {
+		coin.PriceSource = *u.PriceSource
+	}
+	if u.Grade != nil {
+		coin.Grade = *u.Grade
+	}
+	if u.GradingService != nil {
+		coin.GradingService = *u.GradingService
+	}
+	if u.CertNumber != nil {
+		coin.CertNumber = *u.CertNumber
+	}
+	if u.Designations != nil {
+		coin.Designations = u.Designations
+	}
+	if u.Legends != nil {
+		coin.Legends = *u.Legends
+	}
+	if u.Description != nil {
+		coin.Description = *u.Description
+	}
+	if u.Genres != nil {
+		coin.Genres = u.Genres
+	}
+}
+
+// The readCoinUpdate() helper reads a plain JSON update from the request body and
+// copies the fields that were provided into the coin.
+func (app *application) readCoinUpdate(w http.ResponseWriter, r *http.Request, coin *data.Coin) error {
+	var input coinUpdate
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		return err
+	}
+	input.applyTo(coin)
+	return nil
+}
+
+// The values accepted by the sort parameter of the coin list and export endpoints.
+var coinSortSafelist = []string{"id", "title", "year", "country", "face_value", "mintage", "price", "grade", "relevance", "-id", "-title", "-year", "-country", "-face_value", "-mintage", "-price", "-grade"}
+
+// The readCoinQuery() helper reads and validates the search and filter parameters shared
+// by the coin list and export endpoints.
+func (app *application) readCoinQuery(qs url.Values, v *validator.Validator) data.CoinQuery {
+	var q data.CoinQuery
+	q.Title = app.readString(qs, "title", "")
+	q.Search = app.readString(qs, "q", "")
+	q.Language = app.readString(qs, "language", "simple")
+	q.SearchMode = app.readString(qs, "search_mode", "fulltext")
+	q.Highlight = app.readBool(qs, "highlight", false, v)
+	q.Genres = app.readCSV(qs, "genres", []string{})
+	q.GenresMatch = app.readString(qs, "genres_match", "all")
+	q.ExcludeGenres = app.readCSV(qs, "exclude_genres", []string{})
+	q.ExcludeCountries = app.readCSV(qs, "exclude_countries", []string{})
+	q.YearMin = int32(app.readInt(qs, "year_min", 0, v))
+	q.YearMax = int32(app.readInt(qs, "year_max", 0, v))
+	q.PriceMin = app.readMoney(qs, "price_min", v)
+	q.PriceMax = app.readMoney(qs, "price_max", v)
+	q.GradeMin = app.readInt(qs, "grade_min", 0, v)
+	q.GradeMax = app.readInt(qs, "grade_max", 0, v)
+	q.CreatedFrom = app.readDate(qs, "created_from", v)
+	q.CreatedTo = app.readDate(qs, "created_to", v)
+	data.ValidateCoinQuery(v, q)
+	return q
+}
+
+// The readIncludes() helper reads the related resources to embed in each coin. Images
+// are included by default, so an include parameter which is present but empty is how a
+// client asks for no related resources at all.
+func (app *application) readIncludes(qs url.Values) []string {
+	if qs.Has("include") && qs.Get("include") == "" {
+		return []string{}
+	}
+	return app.readCSV(qs, "include", []string{"images"})
+}
+
 func (app *application) listCoinsHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Title  string   `json:"title"`
-		Genres []string `json:"genres"`
+		data.CoinQuery
+		Currency string
 		data.Filters
 	}
 
 	v := validator.New()
 	qs := r.URL.Query()
-	input.Title = app.readString(qs, "title", "")
-	input.Genres = app.readCSV(qs, "genres", []string{})
+	input.CoinQuery = app.readCoinQuery(qs, v)
+	input.Currency = app.readString(qs, "currency", "")
+	if input.Currency != "" {
+		v.Check(data.KnownCurrency(input.Currency), "currency", "must use a supported ISO 4217 currency code")
+	}
 	input.Filters.Page = app.readInt(qs, "page", 1, v)
 	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
 	input.Filters.Sort = app.readString(qs, "sort", "id")
-	input.Filters.SortSafelist = []string{"id", "title", "year", "runtime", "-id", "-title", "-year", "-runtime"}
+	input.Filters.SortSafelist = coinSortSafelist
+	input.Filters.Facets = app.readCSV(qs, "facets", []string{})
+	input.Filters.After = app.readString(qs, "after", "")
+	input.Filters.Fields = app.readCSV(qs, "fields", []string{})
+	input.Filters.FieldSafelist = data.CoinFields
+	includes := app.readIncludes(qs)
+	data.ValidateFields(v, "include", includes, data.CoinIncludes)
+	input.Filters.Before = app.readString(qs, "before", "")
+	input.Filters.SkipCount = !app.readBool(qs, "count", true, v)
 
+	if input.Sort == "relevance" {
+		v.Check(input.Search != "", "sort", "relevance can only be used with a q search term")
+	}
+	if input.After != "" || input.Before != "" {
+		v.Check(!validator.In(input.Sort, "price", "-price", "relevance"), "sort", "cannot be used with after or before cursors")
+	}
 	if data.ValidateFilters(v, input.Filters); !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
-	coins, metadata, err := app.models.Coins.GetAll(input.Title, input.Genres, input.Filters)
+	coins, metadata, err := app.models.Coins.GetAll(input.CoinQuery, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.includeRelated(includes, coins...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"metadata": metadata}
+	if input.Currency != "" {
+		snapshot, err := app.convertPrices(input.Currency, coins...)
+		if err != nil {
+			app.conversionErrorResponse(w, r, err)
+			return
+		}
+		env["exchange_rates"] = snapshot
+	}
+	env["coins"], err = sparseCoins(input.Fields, coins...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// suggestCoinsHandler returns title completions for a partial search term, for a
+// search-as-you-type UI. It's deliberately much lighter than listCoinsHandler: there are
+// no filters or pagination, just the top matching titles.
+func (app *application) suggestCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	term := strings.TrimSpace(app.readString(qs, "q", ""))
+	limit := app.readInt(qs, "limit", 10, v)
+
+	v.Check(term != "", "q", "must be provided")
+	v.Check(len(term) <= 100, "q", "must not be more than 100 bytes long")
+	v.Check(limit > 0, "limit", "must be greater than zero")
+	v.Check(limit <= 20, "limit", "must be a maximum of 20")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	suggestions, err := app.models.Coins.Suggest(term, limit)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"coins": coins, "metadata": metadata}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"suggestions": suggestions}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// maxBatchOperations limits the number of operations in a single batch request, which
+// are all applied in one transaction.
+const maxBatchOperations = 1000
+
+// batchOperation is one operation in a batch request. Updates and deletes must give the
+// version of the coin that they were based on, which is checked in the same way as an
+// If-Match header. The coin holds the fields of a new coin for a create, and the fields
+// to change for an update, like the body of a PATCH request.
+type batchOperation struct {
+	Op      string      `json:"op"`
+	ID      int64       `json:"id"`
+	Version int32       `json:"version"`
+	Coin    *coinUpdate `json:"coin"`
+}
+
+// batchResult is the outcome of one operation in a batch. The status is the HTTP status
+// code that the equivalent single request would have returned, and the error has the
+// same form as the error in that request's response.
+type batchResult struct {
+	Op      string      `json:"op"`
+	ID      int64       `json:"id,omitempty"`
+	Status  int         `json:"status"`
+	Version int32       `json:"version,omitempty"`
+	Error   interface{} `json:"error,omitempty"`
+}
+
+// batchReport summarises the result of a batch request.
+type batchReport struct {
+	Mode      string        `json:"mode"`
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// batchCoinsHandler applies a list of create, update and delete operations in a single
+// request. In the default "atomic" mode, either every operation is applied or none of
+// them are; in "best_effort" mode, the operations that succeed are applied even if
+// others fail. Either way, the response has a result for each operation, in order.
+func (app *application) batchCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       string           `json:"mode"`
+		Operations []batchOperation `json:"operations"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	if input.Mode == "" {
+		input.Mode = "atomic"
+	}
+
+	v := validator.New()
+	v.Check(validator.In(input.Mode, "atomic", "best_effort"), "mode", "must be atomic or best_effort")
+	v.Check(len(input.Operations) > 0, "operations", "must contain at least one operation")
+	v.Check(len(input.Operations) <= maxBatchOperations, "operations", fmt.Sprintf("must not contain more than %d operations", maxBatchOperations))
+	// Each coin can only be changed by one operation in a batch, because the later
+	// operations' versions would depend on the earlier ones being applied.
+	seen := make(map[int64]bool)
+	for i, op := range input.Operations {
+		key := fmt.Sprintf("operations[%d]", i)
+		switch op.Op {
+		case data.OpCreate:
+			v.Check(op.Coin != nil, key+".coin", "must be provided")
+			v.Check(op.ID == 0, key+".id", "must not be provided for a create")
+			v.Check(op.Version == 0, key+".version", "must not be provided for a create")
+		case data.OpUpdate, data.OpDelete:
+			if op.Op == data.OpUpdate {
+				v.Check(op.Coin != nil, key+".coin", "must be provided")
+			} else {
+				v.Check(op.Coin == nil, key+".coin", "must not be provided for a delete")
+			}
+			v.Check(op.ID > 0, key+".id", "must be a positive integer")
+			v.Check(op.Version > 0, key+".version", "must be provided")
+			v.Check(!seen[op.ID], key+".id", "must not be a coin changed by an earlier operation")
+			seen[op.ID] = true
+		default:
+			v.AddError(key+".op", "must be create, update or delete")
+		}
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check and prepare every operation before any of them are applied, so that an
+	// atomic batch with an invalid operation doesn't touch the database at all.
+	atomic := input.Mode == "atomic"
+	results := make([]batchResult, len(input.Operations))
+	var batch []*data.CoinOperation
+	var indexes []int
+	failed := false
+	for i, op := range input.Operations {
+		results[i] = batchResult{Op: op.Op, ID: op.ID}
+		coinOp, status, message, err := app.prepareCoinOperation(op)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if coinOp == nil {
+			results[i].Status, results[i].Error = status, message
+			failed = true
+			continue
+		}
+		batch = append(batch, coinOp)
+		indexes = append(indexes, i)
+	}
+
+	if len(batch) > 0 && !(atomic && failed) {
+		// Look up the images of the coins being deleted beforehand, because the image
+		// records are removed along with the coins but the files in blob storage aren't.
+		var deleteIDs []int64
+		for _, coinOp := range batch {
+			if coinOp.Op == data.OpDelete {
+				deleteIDs = append(deleteIDs, coinOp.Coin.ID)
+			}
+		}
+		var images map[int64][]*data.CoinImage
+		if len(deleteIDs) > 0 {
+			images, err = app.models.Images.GetAllForCoins(deleteIDs...)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		err = app.models.Coins.ApplyBatch(batch, atomic)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		for j, coinOp := range batch {
+			result := &results[indexes[j]]
+			switch {
+			case errors.Is(coinOp.Err, data.ErrDuplicateCertificate):
+				result.Status = http.StatusUnprocessableEntity
+				result.Error = map[string]string{"cert_number": "a coin with this grading service and certificate number already exists"}
+			case errors.Is(coinOp.Err, data.ErrEditConflict):
+				result.Status = http.StatusPreconditionFailed
+				result.Error = "the record has been modified since you retrieved it, please fetch it again"
+			case errors.Is(coinOp.Err, data.ErrRecordNotFound):
+				result.Status = http.StatusNotFound
+				result.Error = "the requested resource could not be found"
+			case coinOp.Op == data.OpCreate:
+				result.Status = http.StatusCreated
+				result.ID, result.Version = coinOp.Coin.ID, coinOp.Coin.Version
+			case coinOp.Op == data.OpUpdate:
+				result.Status = http.StatusOK
+				result.Version = coinOp.Coin.Version
+			default:
+				result.Status = http.StatusOK
+			}
+			if coinOp.Err != nil {
+				failed = true
+			}
+		}
+
+		// An atomic batch with a failed operation wasn't committed, so its coins and
+		// their images are all still there.
+		if !(atomic && failed) {
+			for _, coinOp := range batch {
+				if coinOp.Op == data.OpDelete && coinOp.Err == nil {
+					for _, img := range images[coinOp.Coin.ID] {
+						app.deleteObjects(img.Key, img.ThumbnailKey)
+					}
+				}
+			}
+		}
+	}
+
+	// When an atomic batch fails, nothing was committed, so the operations that didn't
+	// fail themselves are reported as not applied because of the ones that did.
+	report := batchReport{Mode: input.Mode, Results: results}
+	for i := range results {
+		result := &results[i]
+		if atomic && failed && result.Status < 400 {
+			result.Status = http.StatusFailedDependency
+			result.Error = "not applied because another operation in the batch failed"
+			result.Version = 0
+			if result.Op == data.OpCreate {
+				result.ID = 0
+			}
+		}
+		if result.Status < 400 {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"batch": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// prepareCoinOperation reads the coin that an operation applies to, checks its version,
+// applies any changes to it and validates the result. If the operation can't be
+// applied, a nil operation is returned along with the status code and error message
+// that describe why.
+func (app *application) prepareCoinOperation(op batchOperation) (*data.CoinOperation, int, interface{}, error) {
+	coin := &data.Coin{}
+	if op.Op != data.OpCreate {
+		// Deletes only need the version, so don't read the rest of the coin.
+		var fields []string
+		if op.Op == data.OpDelete {
+			fields = []string{"id"}
+		}
+		var err error
+		coin, err = app.models.Coins.Get(op.ID, fields...)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return nil, http.StatusNotFound, "the requested resource could not be found", nil
+			default:
+				return nil, 0, nil, err
+			}
+		}
+		if coin.Version != op.Version {
+			return nil, http.StatusPreconditionFailed, "the record has been modified since you retrieved it, please fetch it again", nil
+		}
+	}
+	if op.Coin != nil {
+		op.Coin.applyTo(coin)
+		v := validator.New()
+		if data.ValidateCoin(v, coin); !v.Valid() {
+			return nil, http.StatusUnprocessableEntity, v.Errors, nil
+		}
+	}
+	return &data.CoinOperation{Op: op.Op, Coin: coin}, 0, nil, nil
+}
@@ -15,6 +15,14 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// sessionIDContextKey is the key for the ID of the session (the token family) that the
+// request's authentication token belongs to.
+const sessionIDContextKey = contextKey("sessionID")
+
+// permissionsContextKey is the key for the permissions carried by a signed access
+// token.
+const permissionsContextKey = contextKey("permissions")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use our userContextKey constant as the
 // key.
@@ -34,3 +42,31 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// The contextSetSessionID() method returns a new copy of the request with the ID of its
+// session added to the context.
+func (app *application) contextSetSessionID(r *http.Request, id int64) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetSessionID() method retrieves the ID of the request's session from the
+// context, or 0 if the request wasn't made with an authentication token.
+func (app *application) contextGetSessionID(r *http.Request) int64 {
+	id, _ := r.Context().Value(sessionIDContextKey).(int64)
+	return id
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the user's
+// permissions added to the context, for requests made with a signed access token.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() method retrieves the user's permissions from the context.
+// It returns false if they aren't there, and need to be read from the database.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
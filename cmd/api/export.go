@@ -0,0 +1,358 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// exportColumn is one column of a CSV or XLSX export. The value is a string, an int64, a
+// float64, or nil for an empty cell.
+type exportColumn struct {
+	name  string
+	value func(coin *data.Coin) interface{}
+}
+
+// exportColumns lists the columns of CSV and XLSX exports. Apart from id and version,
+// they're the columns accepted by the CSV import, in the same format, so an export can
+// be edited and imported again. Fields which the JSON representation omits when they're
+// empty are exported as empty cells rather than zeros.
+var exportColumns = []exportColumn{
+	{"id", func(c *data.Coin) interface{} { return c.ID }},
+	{"title", func(c *data.Coin) interface{} { return c.Title }},
+	{"year", func(c *data.Coin) interface{} { return exportInt(int64(c.Year)) }},
+	{"year_from", func(c *data.Coin) interface{} { return exportInt(int64(c.YearFrom)) }},
+	{"year_to", func(c *data.Coin) interface{} { return exportInt(int64(c.YearTo)) }},
+	{"era", func(c *data.Coin) interface{} { return c.Era }},
+	{"country", func(c *data.Coin) interface{} { return c.Country }},
+	{"denomination", func(c *data.Coin) interface{} { return c.Denomination }},
+	{"face_value", func(c *data.Coin) interface{} { return exportFloat(c.FaceValue) }},
+	{"composition", func(c *data.Coin) interface{} { return c.Composition }},
+	{"weight", func(c *data.Coin) interface{} { return exportFloat(c.Weight) }},
+	{"diameter", func(c *data.Coin) interface{} { return exportFloat(c.Diameter) }},
+	{"mint", func(c *data.Coin) interface{} { return c.Mint }},
+	{"mintage", func(c *data.Coin) interface{} { return exportInt(c.Mintage) }},
+	{"catalogue_refs", func(c *data.Coin) interface{} { return strings.Join(c.CatalogueRefs, "; ") }},
+	{"price", func(c *data.Coin) interface{} { return exportPrice(c.Price) }},
+	{"price_source", func(c *data.Coin) interface{} { return c.PriceSource }},
+	{"grade", func(c *data.Coin) interface{} { return c.Grade }},
+	{"grading_service", func(c *data.Coin) interface{} { return c.GradingService }},
+	{"cert_number", func(c *data.Coin) interface{} { return c.CertNumber }},
+	{"designations", func(c *data.Coin) interface{} { return strings.Join(c.Designations, "; ") }},
+	{"legends", func(c *data.Coin) interface{} { return c.Legends }},
+	{"description", func(c *data.Coin) interface{} { return c.Description }},
+	{"genres", func(c *data.Coin) interface{} { return strings.Join(c.Genres, "; ") }},
+	{"version", func(c *data.Coin) interface{} { return int64(c.Version) }},
+}
+
+func exportInt(i int64) interface{} {
+	if i == 0 {
+		return nil
+	}
+	return i
+}
+
+func exportFloat(f float64) interface{} {
+	if f == 0 {
+		return nil
+	}
+	return f
+}
+
+func exportPrice(price *data.Money) interface{} {
+	if price == nil {
+		return nil
+	}
+	return price.String()
+}
+
+// formatExportValue formats a column value as text, for the CSV export.
+func formatExportValue(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		panic(fmt.Sprintf("unsupported export value type %T", value))
+	}
+}
+
+// coinExporter writes coins to an export file one at a time. Close must be called after
+// the last coin to finish the file, but doesn't close the underlying writer.
+type coinExporter interface {
+	Write(coin *data.Coin) error
+	Close() error
+}
+
+// coinExportFormat describes one of the formats accepted by ?format= on the export
+// endpoint.
+type coinExportFormat struct {
+	contentType string
+	extension   string
+	new         func(w io.Writer) (coinExporter, error)
+}
+
+var coinExportFormats = map[string]coinExportFormat{
+	"csv":    {"text/csv; charset=utf-8", "csv", newCSVCoinExporter},
+	"ndjson": {"application/x-ndjson", "ndjson", newNDJSONCoinExporter},
+	"xlsx":   {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx", newXLSXCoinExporter},
+}
+
+// exportCoinsHandler streams every coin matching the same search and filter parameters
+// as listCoinsHandler to a CSV, NDJSON or XLSX file download. There's no pagination:
+// the coins are written to the response as they're read from the database, so the
+// whole catalogue can be exported without being held in memory.
+func (app *application) exportCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	qs := r.URL.Query()
+	query := app.readCoinQuery(qs, v)
+	name := app.readString(qs, "format", "csv")
+	filters := data.Filters{
+		Sort:         app.readString(qs, "sort", "id"),
+		SortSafelist: coinSortSafelist,
+	}
+
+	format, ok := coinExportFormats[name]
+	v.Check(ok, "format", "must be csv, ndjson or xlsx")
+	v.Check(validator.In(filters.Sort, filters.SortSafelist...), "sort", "invalid sort value")
+	if filters.Sort == "relevance" {
+		v.Check(query.Search != "", "sort", "relevance can only be used with a q search term")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// A large export can take longer to send than the server's write timeout allows, so
+	// lift the deadline for this response. The query is still cancelled if the client
+	// disconnects, because it uses the request context.
+	err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	filename := fmt.Sprintf("coins-%s.%s", time.Now().UTC().Format("2006-01-02"), format.extension)
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	// The exporters buffer their output, so nothing is sent until the first buffer is
+	// flushed. An error before then, like the query failing, can still be reported with
+	// a normal error response. After it, the status code and headers have been sent, so
+	// the error can only be logged, and the client will see a truncated file.
+	cw := &countingWriter{w: w}
+	exporter, err := format.new(cw)
+	if err == nil {
+		err = app.models.Coins.Stream(r.Context(), query, filters, exporter.Write)
+		if err == nil {
+			err = exporter.Close()
+		}
+	}
+	if err != nil {
+		if cw.n == 0 {
+			w.Header().Del("Content-Disposition")
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		app.logError(r, err)
+	}
+}
+
+// countingWriter counts the bytes written through it, to tell whether any of the
+// response body has been sent yet.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// csvCoinExporter writes coins as CSV, with a header row of column names. Lists are
+// separated by semicolons, as in the CSV import.
+type csvCoinExporter struct {
+	w      *csv.Writer
+	record []string
+}
+
+func newCSVCoinExporter(w io.Writer) (coinExporter, error) {
+	e := &csvCoinExporter{w: csv.NewWriter(w), record: make([]string, len(exportColumns))}
+	for i, col := range exportColumns {
+		e.record[i] = col.name
+	}
+	return e, e.w.Write(e.record)
+}
+
+func (e *csvCoinExporter) Write(coin *data.Coin) error {
+	for i, col := range exportColumns {
+		value := col.value(coin)
+		e.record[i] = formatExportValue(value)
+		if _, ok := value.(string); ok {
+			e.record[i] = escapeCSVFormula(e.record[i])
+		}
+	}
+	return e.w.Write(e.record)
+}
+
+// escapeCSVFormula stops spreadsheet applications from running text from the catalogue
+// as a formula when the export is opened (CSV injection), by prefixing text which starts
+// with a formula character with an apostrophe. Numbers aren't text, so negative values
+// are left alone. The apostrophe will be kept if the file is imported again.
+func escapeCSVFormula(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+func (e *csvCoinExporter) Close() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// ndjsonCoinExporter writes coins as newline-delimited JSON, one coin per line, in the
+// same representation as the rest of the API.
+type ndjsonCoinExporter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func newNDJSONCoinExporter(w io.Writer) (coinExporter, error) {
+	bw := bufio.NewWriter(w)
+	return &ndjsonCoinExporter{w: bw, enc: json.NewEncoder(bw)}, nil
+}
+
+func (e *ndjsonCoinExporter) Write(coin *data.Coin) error {
+	return e.enc.Encode(coin)
+}
+
+func (e *ndjsonCoinExporter) Close() error {
+	return e.w.Flush()
+}
+
+// The fixed parts of an XLSX workbook with a single worksheet. An XLSX file is a zip
+// archive of SpreadsheetML parts, and these are the minimum that spreadsheet
+// applications need to open one.
+var xlsxParts = []struct {
+	name    string
+	content string
+}{
+	{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+		`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+		`<Default Extension="xml" ContentType="application/xml"/>` +
+		`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+		`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+		`</Types>`},
+	{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+		`</Relationships>`},
+	{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="Coins" sheetId="1" r:id="rId1"/></sheets>` +
+		`</workbook>`},
+	{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+		`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+		`</Relationships>`},
+}
+
+// xlsxMaxCellLength is the most characters that a spreadsheet cell can hold. Longer
+// text is truncated, because Excel refuses to open files with longer cells.
+const xlsxMaxCellLength = 32767
+
+// xlsxCoinExporter writes coins as an XLSX workbook. The worksheet is the last entry in
+// the zip archive, so it can be written a row at a time as the coins arrive. Text is
+// written as inline strings, rather than in a shared string table, which would have to
+// be held in memory until the end of the export.
+type xlsxCoinExporter struct {
+	zw  *zip.Writer
+	w   *bufio.Writer
+	row int
+}
+
+func newXLSXCoinExporter(w io.Writer) (coinExporter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.WriteString(f, part.content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	e := &xlsxCoinExporter{zw: zw, w: bufio.NewWriter(sheet)}
+	e.w.WriteString(xml.Header)
+	e.w.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	// Freeze the header row, so that it stays in view while scrolling.
+	e.w.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	e.w.WriteString(`<sheetData>`)
+	header := make([]interface{}, len(exportColumns))
+	for i, col := range exportColumns {
+		header[i] = col.name
+	}
+	return e, e.writeRow(header)
+}
+
+func (e *xlsxCoinExporter) Write(coin *data.Coin) error {
+	values := make([]interface{}, len(exportColumns))
+	for i, col := range exportColumns {
+		values[i] = col.value(coin)
+	}
+	return e.writeRow(values)
+}
+
+func (e *xlsxCoinExporter) writeRow(values []interface{}) error {
+	e.row++
+	fmt.Fprintf(e.w, `<row r="%d">`, e.row)
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			e.w.WriteString(`<c/>`)
+		case string:
+			if utf8.RuneCountInString(value) > xlsxMaxCellLength {
+				value = string([]rune(value)[:xlsxMaxCellLength])
+			}
+			e.w.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(e.w, []byte(value))
+			e.w.WriteString(`</t></is></c>`)
+		default:
+			fmt.Fprintf(e.w, `<c><v>%s</v></c>`, formatExportValue(value))
+		}
+	}
+	// Errors are sticky in a bufio.Writer, so checking the last write is enough.
+	_, err := e.w.WriteString(`</row>`)
+	return err
+}
+
+func (e *xlsxCoinExporter) Close() error {
+	e.w.WriteString(`</sheetData></worksheet>`)
+	err := e.w.Flush()
+	if err != nil {
+		return err
+	}
+	return e.zw.Close()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The includeRelated() helper embeds the related resources named in includes (images
+// and/or prices) in each of the coins, with one query per kind of resource.
+func (app *application) includeRelated(includes []string, coins ...*data.Coin) error {
+	if validator.In("images", includes...) {
+		err := app.attachImages(coins...)
+		if err != nil {
+			return err
+		}
+	}
+	if validator.In("prices", includes...) {
+		err := app.attachPrices(coins...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The sparseCoins() helper returns the coins as JSON objects containing only the
+// requested fields, for a response with a sparse fieldset. The coins will have been
+// read with only those columns, but fields without omitempty in the Coin struct tags
+// would otherwise still be sent with zero values. The id, embedded resources and
+// calculated fields (like converted_price) aren't columns, so they're always kept if
+// they're present. If no fields were requested, the coins are returned unchanged.
+func sparseCoins(fields []string, coins ...*data.Coin) ([]interface{}, error) {
+	objects := make([]interface{}, len(coins))
+	for i, coin := range coins {
+		if len(fields) == 0 {
+			objects[i] = coin
+			continue
+		}
+		js, err := json.Marshal(coin)
+		if err != nil {
+			return nil, err
+		}
+		var object map[string]json.RawMessage
+		err = json.Unmarshal(js, &object)
+		if err != nil {
+			return nil, err
+		}
+		for key := range object {
+			if key != "id" && validator.In(key, data.CoinFields...) && !validator.In(key, fields...) {
+				delete(object, key)
+			}
+		}
+		objects[i] = object
+	}
+	return objects, nil
+}
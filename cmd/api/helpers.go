@@ -9,18 +9,26 @@ import (
 	"net/url"
 	"strconv"
 	"strings" // New import
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/validator"
 )
 
 // Retrieve the "id" URL parameter from the current request context, then convert it to
 // an integer and return it. If the operation isn't successful, return 0 and an error.
 func (app *application) readIDParam(r *http.Request) (int64, error) {
+	return app.readNamedIDParam(r, "id")
+}
+
+// The readNamedIDParam() helper works like readIDParam(), but for routes with more than
+// one ID in the URL, like /v1/coins/:id/images/:image_id.
+func (app *application) readNamedIDParam(r *http.Request, name string) (int64, error) {
 	params := httprouter.ParamsFromContext(r.Context())
-	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	id, err := strconv.ParseInt(params.ByName(name), 10, 64)
 	if err != nil || id < 1 {
-		return 0, errors.New("invalid id parameter")
+		return 0, fmt.Errorf("invalid %s parameter", name)
 	}
 	return id, nil
 }
@@ -102,6 +110,35 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+// The readMultipartFile() helper reads a single file from a multipart/form-data request
+// body into memory, limiting the size of the whole body to maxBytes. The other form
+// fields are available from r.FormValue() afterwards.
+func (app *application) readMultipartFile(w http.ResponseWriter, r *http.Request, field string, maxBytes int64) ([]byte, error) {
+	// Allow a little extra room for the multipart boundaries and the other form fields.
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes+1_048_576)
+	err := r.ParseMultipartForm(maxBytes)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			return nil, fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		case errors.Is(err, http.ErrNotMultipart):
+			return nil, errors.New("body must be multipart/form-data")
+		default:
+			return nil, err
+		}
+	}
+	f, header, err := r.FormFile(field)
+	if err != nil {
+		return nil, fmt.Errorf("body must contain a %q file", field)
+	}
+	defer f.Close()
+	if header.Size > maxBytes {
+		return nil, fmt.Errorf("%s must not be larger than %d bytes", field, maxBytes)
+	}
+	return io.ReadAll(f)
+}
+
 // The readString() helper returns a string value from the query string, or the provided
 // default value if no matching key could be found.
 func (app *application) readString(qs url.Values, key string, defaultValue string) string {
@@ -151,6 +188,83 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	// Otherwise, return the converted integer value.
 	return i
 }
+
+// The readBool() helper reads a boolean value ("true" or "false", or any other value
+// accepted by strconv.ParseBool) from the query string. If no matching key could be
+// found it returns the provided default value, and if the value couldn't be converted
+// then we record an error message in the provided Validator instance.
+func (app *application) readBool(qs url.Values, key string, defaultValue bool, v *validator.Validator) bool {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return defaultValue
+	}
+	return b
+}
+
+// The readMoney() helper reads a money value in the format "<amount> <currency>" (for
+// example "500.00 USD") from the query string. If no matching key could be found it
+// returns nil, and if the value couldn't be parsed then we record an error message in
+// the provided Validator instance.
+func (app *application) readMoney(qs url.Values, key string, v *validator.Validator) *data.Money {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+	m, err := data.ParseMoney(s)
+	if err != nil {
+		v.AddError(key, `must be in the format "<amount> <currency>"`)
+		return nil
+	}
+	return &m
+}
+
+// The readDate() helper reads a date in the format YYYY-MM-DD from the query string. If
+// no matching key could be found it returns the zero time, and if the value couldn't be
+// parsed then we record an error message in the provided Validator instance.
+func (app *application) readDate(qs url.Values, key string, v *validator.Validator) time.Time {
+	s := qs.Get(key)
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		v.AddError(key, "must be a date in the format YYYY-MM-DD")
+		return time.Time{}
+	}
+	return t
+}
+
+// The etag() helper returns the entity tag for a version of a record. The version is
+// bumped on every update, so it identifies the state of the record on its own.
+func etag(version int32) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// The etagMatches() helper reports whether an If-Match or If-None-Match header value
+// (a comma-separated list of entity tags, or "*") includes the given tag. If-Match uses
+// the strong comparison, where weak tags never match, and If-None-Match uses the weak
+// comparison, which ignores the W/ prefix.
+func etagMatches(header, tag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
 func (app *application) background(fn func()) {
 	// Increment the WaitGroup counter.
 	app.wg.Add(1)
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	_ "image/gif" // Register the GIF decoder.
+
+	"github.com/julienschmidt/httprouter"
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/imaging"
+	"greenlight.alexedwards.net/internal/storage"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+const (
+	// maxImagePixels guards against "decompression bombs": small files which decode to
+	// enormous images.
+	maxImagePixels = 50_000_000
+	thumbnailSize  = 300
+)
+
+// The uploadCoinImageHandler() accepts a multipart/form-data request with a "side"
+// field and an "image" file, stores the image and a generated thumbnail, and records
+// them against the coin.
+func (app *application) uploadCoinImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Coins.Get(id, "id")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	file, err := app.readMultipartFile(w, r, "image", app.config.images.maxBytes)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	img := &data.CoinImage{
+		CoinID:      id,
+		Side:        r.FormValue("side"),
+		ContentType: http.DetectContentType(file),
+		Size:        int64(len(file)),
+	}
+
+	// Decode the image header first to check its dimensions before decoding the whole
+	// thing. If it can't be decoded at all, the validator will reject it because the
+	// width and height are zero.
+	v := validator.New()
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(file))
+	if err == nil {
+		img.Width, img.Height = cfg.Width, cfg.Height
+		v.Check(cfg.Width*cfg.Height <= maxImagePixels, "image", "must not be more than 50 megapixels")
+	}
+	if data.ValidateCoinImage(v, img); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	decoded, _, err := image.Decode(bytes.NewReader(file))
+	if err != nil {
+		v.AddError("image", "could not be decoded")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// JPEG can't hold transparency, so PNG and GIF uploads get PNG thumbnails.
+	thumb := new(bytes.Buffer)
+	thumbType := "image/png"
+	if img.ContentType == "image/jpeg" {
+		thumbType = "image/jpeg"
+		err = jpeg.Encode(thumb, imaging.Thumbnail(decoded, thumbnailSize), &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(thumb, imaging.Thumbnail(decoded, thumbnailSize))
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	name, err := randomName()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	img.Key = fmt.Sprintf("coins/%d/%s-%s%s", id, img.Side, name, extensionFor(img.ContentType))
+	img.ThumbnailKey = fmt.Sprintf("coins/%d/%s-%s-thumb%s", id, img.Side, name, extensionFor(thumbType))
+
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	err = app.storage.Put(ctx, img.Key, bytes.NewReader(file), img.ContentType)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.storage.Put(ctx, img.ThumbnailKey, thumb, thumbType)
+	if err != nil {
+		app.deleteObjects(img.Key)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Images.Insert(img)
+	if err != nil {
+		app.deleteObjects(img.Key, img.ThumbnailKey)
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.setImageURLs(r.Context(), img)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	headers := make(http.Header)
+	headers.Set("Location", img.URL)
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"image": img}, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listCoinImagesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	_, err = app.models.Coins.Get(id, "id")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	images, err := app.models.Images.GetAllForCoins(id)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	err = app.setImageURLs(r.Context(), images[id]...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"images": images[id]}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteCoinImageHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	imageID, err := app.readNamedIDParam(r, "image_id")
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	img, err := app.models.Images.Get(id, imageID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Images.Delete(id, imageID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.deleteObjects(img.Key, img.ThumbnailKey)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "image successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The showFileHandler() streams an object from blob storage to the client. It serves
+// the signed URLs generated by stores that don't serve files themselves (like the
+// local filesystem store), so the signature takes the place of authentication.
+func (app *application) showFileHandler(w http.ResponseWriter, r *http.Request) {
+	verifier, ok := app.storage.(storage.URLVerifier)
+	if !ok {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	key := params.ByName("key")[1:] // Strip the leading slash from the catch-all parameter.
+
+	err := verifier.VerifySignedURL(key, r.URL.Query())
+	if err != nil {
+		app.invalidSignatureResponse(w, r)
+		return
+	}
+
+	f, err := app.storage.Get(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrInvalidKey):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	defer f.Close()
+
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	_, err = io.Copy(w, f)
+	if err != nil {
+		app.logError(r, err)
+	}
+}
+
+// The setImageURLs() helper fills in the URL fields of images with signed URLs for
+// their storage keys, so that clients can fetch them without an Authorization header
+// (for example, from an <img> tag).
+func (app *application) setImageURLs(ctx context.Context, images ...*data.CoinImage) error {
+	for _, img := range images {
+		var err error
+		img.URL, err = app.storage.SignedURL(ctx, img.Key, app.config.storage.urlTTL)
+		if err != nil {
+			return err
+		}
+		img.ThumbnailURL, err = app.storage.SignedURL(ctx, img.ThumbnailKey, app.config.storage.urlTTL)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The attachImages() helper loads the images for a set of coins with a single query
+// and adds them to each coin.
+func (app *application) attachImages(coins ...*data.Coin) error {
+	if len(coins) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(coins))
+	for i, coin := range coins {
+		ids[i] = coin.ID
+	}
+	images, err := app.models.Images.GetAllForCoins(ids...)
+	if err != nil {
+		return err
+	}
+	for _, coin := range coins {
+		err = app.setImageURLs(context.Background(), images[coin.ID]...)
+		if err != nil {
+			return err
+		}
+		coin.Images = images[coin.ID]
+	}
+	return nil
+}
+
+// The deleteObjects() helper removes objects from blob storage in the background,
+// logging rather than returning any errors, because the database records that
+// referenced them are already gone.
+func (app *application) deleteObjects(keys ...string) {
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		for _, key := range keys {
+			err := app.storage.Delete(ctx, key)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"key": key})
+			}
+		}
+	})
+}
+
+func randomName() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func extensionFor(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	default:
+		return ""
+	}
+}
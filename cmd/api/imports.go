@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+const (
+	// importBatchSize is the number of valid rows inserted in each transaction.
+	importBatchSize = 500
+	// maxImportErrors limits the number of row errors in an import report, so that a
+	// file in completely the wrong format doesn't produce an enormous response.
+	maxImportErrors = 1000
+)
+
+// importRowError is a problem with one field of one row in an import file. Problems
+// that don't belong to a particular field, like a malformed line, have no field.
+type importRowError struct {
+	Line    int    `json:"line"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// importReport summarises the result of an import.
+type importReport struct {
+	DryRun          bool             `json:"dry_run"`
+	Rows            int              `json:"rows"`
+	Valid           int              `json:"valid"`
+	Inserted        int              `json:"inserted"`
+	Failed          int              `json:"failed"`
+	Errors          []importRowError `json:"errors"`
+	ErrorsTruncated bool             `json:"errors_truncated,omitempty"`
+	// Error is set if the import stopped early because the rest of the file couldn't
+	// be read.
+	Error string `json:"error,omitempty"`
+}
+
+// addErrors records the errors for a failed row, using the same field-to-message map
+// as a validator.Validator. The fields are sorted so that the report is deterministic.
+func (report *importReport) addErrors(line int, errs map[string]string) {
+	report.Failed++
+	fields := make([]string, 0, len(errs))
+	for field := range errs {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if len(report.Errors) == maxImportErrors {
+			report.ErrorsTruncated = true
+			return
+		}
+		report.Errors = append(report.Errors, importRowError{Line: line, Field: field, Message: errs[field]})
+	}
+}
+
+// coinRow is one row read from an import file. If the row couldn't be parsed, Errors
+// holds the problems with it, and Doc shouldn't be used.
+type coinRow struct {
+	Line   int
+	Doc    coinDocument
+	Errors map[string]string
+}
+
+// coinRowReader reads the rows of an import file one at a time, returning io.EOF after
+// the last row. Any other error means that the rest of the file can't be read.
+type coinRowReader interface {
+	Next() (*coinRow, error)
+}
+
+// The importCoinsHandler() adds coins in bulk from a CSV or NDJSON file in the request
+// body. The file is read as a stream, and each row is validated with ValidateCoin()
+// and inserted in batches, so that large files don't have to be held in memory. Rows
+// with errors are skipped and listed in the report, along with the line number. With
+// ?dry_run=true, the rows are only validated.
+func (app *application) importCoinsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+	dryRun := app.readBool(r.URL.Query(), "dry_run", false, v)
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	// A large file is read and inserted a batch at a time, which can take far longer
+	// than the server's read and write timeouts allow, so lift the deadlines for this
+	// request. The body is still limited in size by the MaxBytesReader.
+	rc := http.NewResponseController(w)
+	err = rc.SetReadDeadline(time.Time{})
+	if err == nil {
+		err = rc.SetWriteDeadline(time.Time{})
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, app.config.imports.maxBytes)
+	var rows coinRowReader
+	switch mediaType {
+	case "text/csv":
+		rows, err = newCSVCoinReader(r.Body)
+		if err != nil {
+			app.badRequestResponse(w, r, err)
+			return
+		}
+	case "application/x-ndjson", "application/ndjson":
+		rows = newNDJSONCoinReader(r.Body)
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+
+	report := &importReport{DryRun: dryRun, Errors: []importRowError{}}
+	var batch []*data.Coin
+	var lines []int
+	flush := func() error {
+		if len(batch) == 0 || dryRun {
+			batch, lines = nil, nil
+			return nil
+		}
+		skipped, err := app.models.Coins.InsertBatch(batch)
+		if err != nil {
+			return err
+		}
+		for i, err := range skipped {
+			if errors.Is(err, data.ErrDuplicateCertificate) {
+				report.Valid--
+				report.addErrors(lines[i], map[string]string{"cert_number": "a coin with this grading service and certificate number already exists"})
+			}
+		}
+		report.Inserted += len(batch) - len(skipped)
+		batch, lines = nil, nil
+		return nil
+	}
+
+	// If a batch can't be inserted, the import stops there. The earlier batches have
+	// already been committed, so the report is still returned to say which rows made it
+	// in, with the details of the failure logged rather than sent to the client.
+	flushOrReport := func() error {
+		line := 0
+		if len(lines) > 0 {
+			line = lines[0]
+		}
+		err := flush()
+		if err != nil {
+			app.logError(r, err)
+			message := fmt.Sprintf("could not insert the rows from line %d onwards, so the import was stopped", line)
+			if report.Error != "" {
+				message = report.Error + "; " + message
+			}
+			report.Error = message
+		}
+		return err
+	}
+
+	insertFailed := false
+	for {
+		row, err := rows.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// The rest of the file can't be read, but the batches that have already been
+			// inserted stay inserted, and the valid rows read so far are inserted below,
+			// so report the problem alongside them rather than failing the whole request.
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				err = fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+			}
+			report.Error = fmt.Sprintf("could not read the file after row %d: %v", report.Rows, err)
+			break
+		}
+
+		report.Rows++
+		if row.Errors != nil {
+			report.addErrors(row.Line, row.Errors)
+			continue
+		}
+		coin := &data.Coin{}
+		row.Doc.applyTo(coin)
+		v := validator.New()
+		if data.ValidateCoin(v, coin); !v.Valid() {
+			report.addErrors(row.Line, v.Errors)
+			continue
+		}
+		report.Valid++
+		batch = append(batch, coin)
+		lines = append(lines, row.Line)
+		if len(batch) == importBatchSize {
+			err = flushOrReport()
+			if err != nil {
+				insertFailed = true
+				break
+			}
+		}
+	}
+	// Insert the last, partial batch, unless the import was stopped by an earlier batch
+	// failing to insert.
+	if !insertFailed {
+		flushOrReport()
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"import": report}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// csvCoinReader reads coins from a CSV file. The first row is a header naming the
+// column for each field, using the same names as the JSON fields. The title column is
+// required, and the others are optional. Lists (like genres) are separated by
+// semicolons within a cell.
+type csvCoinReader struct {
+	r      *csv.Reader
+	header []string
+}
+
+// csvCoinFields sets each field of a coinDocument from its CSV cell. The errors are
+// reported against the field, so they read as "<field> must be ...".
+var csvCoinFields = map[string]func(d *coinDocument, s string) error{
+	"title":           func(d *coinDocument, s string) error { d.Title = s; return nil },
+	"year":            func(d *coinDocument, s string) error { return parseCSVInt32(s, &d.Year) },
+	"year_from":       func(d *coinDocument, s string) error { return parseCSVInt32(s, &d.YearFrom) },
+	"year_to":         func(d *coinDocument, s string) error { return parseCSVInt32(s, &d.YearTo) },
+	"era":             func(d *coinDocument, s string) error { d.Era = s; return nil },
+	"country":         func(d *coinDocument, s string) error { d.Country = s; return nil },
+	"denomination":    func(d *coinDocument, s string) error { d.Denomination = s; return nil },
+	"face_value":      func(d *coinDocument, s string) error { return parseCSVFloat(s, &d.FaceValue) },
+	"composition":     func(d *coinDocument, s string) error { d.Composition = s; return nil },
+	"weight":          func(d *coinDocument, s string) error { return parseCSVFloat(s, &d.Weight) },
+	"diameter":        func(d *coinDocument, s string) error { return parseCSVFloat(s, &d.Diameter) },
+	"mint":            func(d *coinDocument, s string) error { d.Mint = s; return nil },
+	"mintage":         func(d *coinDocument, s string) error { return parseCSVInt64(s, &d.Mintage) },
+	"catalogue_refs":  func(d *coinDocument, s string) error { d.CatalogueRefs = splitCSVList(s); return nil },
+	"price":           parseCSVPrice,
+	"price_source":    func(d *coinDocument, s string) error { d.PriceSource = s; return nil },
+	"grade":           func(d *coinDocument, s string) error { d.Grade = s; return nil },
+	"grading_service": func(d *coinDocument, s string) error { d.GradingService = s; return nil },
+	"cert_number":     func(d *coinDocument, s string) error { d.CertNumber = s; return nil },
+	"designations":    func(d *coinDocument, s string) error { d.Designations = splitCSVList(s); return nil },
+	"legends":         func(d *coinDocument, s string) error { d.Legends = s; return nil },
+	"description":     func(d *coinDocument, s string) error { d.Description = s; return nil },
+	"genres":          func(d *coinDocument, s string) error { d.Genres = splitCSVList(s); return nil },
+}
+
+func newCSVCoinReader(r io.Reader) (*csvCoinReader, error) {
+	cr := csv.NewReader(r)
+	// Rows with the wrong number of cells are reported as row errors in Next(), rather
+	// than stopping the import.
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("body must not be empty")
+		}
+		return nil, fmt.Errorf("invalid CSV header: %v", err)
+	}
+	seen := make(map[string]bool)
+	for i, column := range header {
+		column = strings.TrimSpace(column)
+		if _, ok := csvCoinFields[column]; !ok {
+			return nil, fmt.Errorf("unknown CSV column %q", column)
+		}
+		if seen[column] {
+			return nil, fmt.Errorf("duplicate CSV column %q", column)
+		}
+		seen[column] = true
+		header[i] = column
+	}
+	if !seen["title"] {
+		return nil, errors.New(`CSV header must include a "title" column`)
+	}
+	return &csvCoinReader{r: cr, header: header}, nil
+}
+
+func (c *csvCoinReader) Next() (*coinRow, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		// A malformed record, like one with a stray quote, only spoils that record:
+		// the reader carries on from the next line, so it's reported as a row error.
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			return &coinRow{Line: parseError.Line, Errors: map[string]string{"": parseError.Err.Error()}}, nil
+		}
+		return nil, err
+	}
+	line, _ := c.r.FieldPos(0)
+	row := &coinRow{Line: line}
+	if len(record) != len(c.header) {
+		row.Errors = map[string]string{"": fmt.Sprintf("has %d columns, but the header has %d", len(record), len(c.header))}
+		return row, nil
+	}
+	for i, column := range c.header {
+		err := csvCoinFields[column](&row.Doc, strings.TrimSpace(record[i]))
+		if err != nil {
+			if row.Errors == nil {
+				row.Errors = make(map[string]string)
+			}
+			row.Errors[column] = err.Error()
+		}
+	}
+	return row, nil
+}
+
+func parseCSVInt32(s string, dst *int32) error {
+	if s == "" {
+		return nil
+	}
+	i, err := strconv.ParseInt(s, 10, 32)
+	if err != nil {
+		return errors.New("must be an integer")
+	}
+	*dst = int32(i)
+	return nil
+}
+
+func parseCSVInt64(s string, dst *int64) error {
+	if s == "" {
+		return nil
+	}
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.New("must be an integer")
+	}
+	*dst = i
+	return nil
+}
+
+func parseCSVFloat(s string, dst *float64) error {
+	if s == "" {
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return errors.New("must be a number")
+	}
+	*dst = f
+	return nil
+}
+
+func parseCSVPrice(d *coinDocument, s string) error {
+	if s == "" {
+		return nil
+	}
+	price, err := data.ParseMoney(s)
+	if err != nil {
+		return errors.New(`must be an amount and currency code, like "12.50 USD"`)
+	}
+	d.Price = &price
+	return nil
+}
+
+func splitCSVList(s string) []string {
+	values := []string{}
+	for _, value := range strings.Split(s, ";") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// ndjsonCoinReader reads coins from newline-delimited JSON, where each non-blank line
+// is a JSON object with the same fields as the body of POST /v1/coins.
+type ndjsonCoinReader struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func newNDJSONCoinReader(r io.Reader) *ndjsonCoinReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1_048_576)
+	return &ndjsonCoinReader{scanner: scanner}
+}
+
+func (n *ndjsonCoinReader) Next() (*coinRow, error) {
+	for n.scanner.Scan() {
+		n.line++
+		js := bytes.TrimSpace(n.scanner.Bytes())
+		if len(js) == 0 {
+			continue
+		}
+		row := &coinRow{Line: n.line}
+		dec := json.NewDecoder(bytes.NewReader(js))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&row.Doc)
+		if err == nil && dec.More() {
+			err = errors.New("line must only contain a single JSON object")
+		}
+		if err != nil {
+			var unmarshalTypeError *json.UnmarshalTypeError
+			switch {
+			case errors.As(err, &unmarshalTypeError) && unmarshalTypeError.Field != "":
+				row.Errors = map[string]string{unmarshalTypeError.Field: "has the wrong JSON type"}
+			case strings.HasPrefix(err.Error(), "json: unknown field "):
+				field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+				row.Errors = map[string]string{field: "is not a coin field"}
+			case errors.Is(err, data.ErrInvalidMoneyFormat):
+				row.Errors = map[string]string{"price": `must be an amount and currency code, like "12.50 USD"`}
+			default:
+				row.Errors = map[string]string{"": "must be a JSON object: " + err.Error()}
+			}
+		}
+		return row, nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
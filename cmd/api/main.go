@@ -1,11 +1,11 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
 	"errors"
 	"flag"
 	"fmt"
-	"net/http"
 	"os" // New import
 	"strings"
 	"sync"
@@ -15,7 +15,8 @@ import (
 	"greenlight.alexedwards.net/internal/data"
 	"greenlight.alexedwards.net/internal/jsonlog"
 	"greenlight.alexedwards.net/internal/mailer"
-	"greenlight.alexedwards.net/internal/validator"
+	"greenlight.alexedwards.net/internal/signedtoken"
+	"greenlight.alexedwards.net/internal/storage"
 )
 
 const version = "1.0.0"
@@ -30,9 +31,11 @@ type config struct {
 		maxIdleTime  string
 	}
 	limiter struct {
-		enabled bool
-		rps     float64
-		burst   int
+		enabled      bool
+		rps          float64
+		burst        int
+		suggestRPS   float64
+		suggestBurst int
 	}
 	smtp struct {
 		host     string
@@ -45,15 +48,42 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	storage struct {
+		backend   string
+		dir       string
+		urlSecret string
+		urlTTL    time.Duration
+		s3        storage.S3Config
+	}
+	images struct {
+		maxBytes int64
+	}
+	imports struct {
+		maxBytes int64
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	// In "stateless" mode, access tokens are signed with the first of the signing keys
+	// instead of being stored in the database. The other keys are only used to verify
+	// tokens, so that keys can be rotated.
+	auth struct {
+		mode        string
+		signingKeys []string
+	}
 }
 
 // Update the application struct to hold a new Mailer instance.
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config  config
+	logger  *jsonlog.Logger
+	models  data.Models
+	mailer  mailer.Mailer
+	wg      sync.WaitGroup
+	storage storage.Store
+	signer  *signedtoken.Keyset
+	revoked *revokedSessions
 }
 
 func main() {
@@ -67,6 +97,8 @@ func main() {
 	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
 	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
 	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	flag.Float64Var(&cfg.limiter.suggestRPS, "suggest-limiter-rps", 10, "Rate limiter maximum requests per second for title suggestions")
+	flag.IntVar(&cfg.limiter.suggestBurst, "suggest-limiter-burst", 20, "Rate limiter maximum burst for title suggestions")
 	// Read the SMTP server configuration settings into the config struct, using the
 	// Mailtrap settings as the default values. IMPORTANT: If you're following along,
 	// make sure to replace the default values for smtp-username and smtp-password
@@ -80,6 +112,25 @@ func main() {
 		cfg.cors.trustedOrigins = strings.Fields(val)
 		return nil
 	})
+	flag.StringVar(&cfg.storage.backend, "storage-backend", "local", "Blob storage backend (local|s3)")
+	flag.StringVar(&cfg.storage.dir, "storage-dir", "./uploads", "Directory for uploaded files (local backend)")
+	flag.StringVar(&cfg.storage.urlSecret, "storage-url-secret", os.Getenv("GREENLIGHT_STORAGE_URL_SECRET"), "Secret for signing file URLs (local backend)")
+	flag.DurationVar(&cfg.storage.urlTTL, "storage-url-ttl", time.Hour, "Lifetime of signed file URLs")
+	flag.StringVar(&cfg.storage.s3.Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "S3 endpoint URL")
+	flag.StringVar(&cfg.storage.s3.Region, "s3-region", "us-east-1", "S3 region")
+	flag.StringVar(&cfg.storage.s3.Bucket, "s3-bucket", "", "S3 bucket")
+	flag.StringVar(&cfg.storage.s3.AccessKey, "s3-access-key", os.Getenv("GREENLIGHT_S3_ACCESS_KEY"), "S3 access key")
+	flag.StringVar(&cfg.storage.s3.SecretKey, "s3-secret-key", os.Getenv("GREENLIGHT_S3_SECRET_KEY"), "S3 secret key")
+	flag.BoolVar(&cfg.storage.s3.PathStyle, "s3-path-style", false, "Use path-style S3 URLs (needed for MinIO)")
+	flag.Int64Var(&cfg.images.maxBytes, "images-max-bytes", 10*1_048_576, "Maximum size of an uploaded image in bytes")
+	flag.Int64Var(&cfg.imports.maxBytes, "import-max-bytes", 50*1_048_576, "Maximum size of a bulk import file in bytes")
+	flag.DurationVar(&cfg.tokens.accessTTL, "access-token-ttl", 15*time.Minute, "Lifetime of authentication (access) tokens")
+	flag.DurationVar(&cfg.tokens.refreshTTL, "refresh-token-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&cfg.auth.mode, "auth-mode", "database", "Access token mode (database|stateless)")
+	flag.Func("signing-keys", "Ed25519 PEM key files for signed access tokens, signing key first (space separated)", func(val string) error {
+		cfg.auth.signingKeys = strings.Fields(val)
+		return nil
+	})
 	flag.Parse()
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 	db, err := openDB(cfg)
@@ -88,13 +139,25 @@ func main() {
 	}
 	defer db.Close()
 	logger.PrintInfo("database connection pool established", nil)
+	store, err := openStore(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	logger.PrintInfo("blob storage configured", map[string]string{"backend": cfg.storage.backend})
+	signer, err := openSigner(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
 	// Initialize a new Mailer instance using the settings from the command line
 	// flags, and add it to the application struct.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:  cfg,
+		logger:  logger,
+		models:  data.NewModels(db),
+		mailer:  mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		storage: store,
+		signer:  signer,
+		revoked: newRevokedSessions(),
 	}
 	err = app.serve()
 	if err != nil {
@@ -133,69 +196,44 @@ func openDB(cfg config) (*sql.DB, error) {
 	return db, nil
 }
 
-func (app *application) updateсoinHandler(w http.ResponseWriter, r *http.Request) {
-	// Extract the coin ID from the URL.
-	id, err := app.readIDParam(r)
-	if err != nil {
-		app.notFoundResponse(w, r)
-		return
-	}
-
-	// Fetch the existing coin record from the database, sending a 404 Not Found
-	// response to the client if we couldn't find a matching record.
-	coin, err := app.models.Coins.Get(id)
-	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
+// The openStore() function returns the blob storage backend chosen by the
+// -storage-backend flag.
+func openStore(cfg config) (storage.Store, error) {
+	switch cfg.storage.backend {
+	case "local":
+		// Without a configured secret, generate a random one. This works fine, but
+		// signed URLs will stop working whenever the server is restarted.
+		secret := []byte(cfg.storage.urlSecret)
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			_, err := rand.Read(secret)
+			if err != nil {
+				return nil, err
+			}
 		}
-		return
-	}
-
-	// Declare an input struct to hold the expected data from the client.
-	var input struct {
-		Title   string       `json:"title"`
-		Year    int32        `json:"year"`
-		Runtime data.Runtime `json:"runtime"`
-		Genres  []string     `json:"genres"`
-	}
-
-	// Read the JSON request body data into the input struct.
-	err = app.readJSON(w, r, &input)
-	if err != nil {
-		app.badRequestResponse(w, r, err)
-		return
-	}
-
-	// Copy the values from the request body to the appropriate fields of the coin
-	// record.
-	// Copy the values from the request body to the appropriate fields of the coin
-	// record.
-	coin.Title = input.Title
-	coin.Year = input.Year
-	coin.Runtime = int32(input.Runtime)
-	coin.Genres = input.Genres
-
-	// Validate the updated coin record, sending the client a 422 Unprocessable Entity
-	// response if any checks fail.
-	v := validator.New()
-	if data.ValidateCoin(v, coin); !v.Valid() {
-		app.failedValidationResponse(w, r, v.Errors)
-		return
-	}
-
-	// Pass the updated coin record to our new Update() method.
-	err = app.models.Coins.Update(coin)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+		return storage.NewLocalStore(cfg.storage.dir, "/v1/files/", secret)
+	case "s3":
+		return storage.NewS3Store(cfg.storage.s3)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.storage.backend)
 	}
+}
 
-	// Write the updated coin record in a JSON response.
-	err = app.writeJSON(w, http.StatusOK, envelope{"coin": coin}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+// openSigner loads the keys for signed access tokens. Signed tokens are verified
+// whenever keys are configured, so that tokens issued in stateless mode keep working
+// for the rest of their (short) lifetime after switching back to database mode.
+func openSigner(cfg config) (*signedtoken.Keyset, error) {
+	switch cfg.auth.mode {
+	case "database":
+		if len(cfg.auth.signingKeys) == 0 {
+			return nil, nil
+		}
+	case "stateless":
+		if len(cfg.auth.signingKeys) == 0 {
+			return nil, errors.New("stateless auth mode needs at least one signing key")
+		}
+	default:
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.auth.mode)
 	}
+	return signedtoken.LoadKeyset(cfg.auth.signingKeys)
 }
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings" // New import
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
-	"greenlight.alexedwards.net/internal/data"      // New import
+	"greenlight.alexedwards.net/internal/data" // New import
+	"greenlight.alexedwards.net/internal/signedtoken"
 	"greenlight.alexedwards.net/internal/validator" // New import
 )
 
@@ -39,7 +41,30 @@ func (app *application) recoverPanic(next http.Handler) http.Handler {
 	})
 }
 
+// rateLimit applies the main per-client rate limit to every request, except for GET
+// requests to the suggestions endpoint. Search-as-you-type sends a request on every
+// keystroke, so that endpoint has its own, more generous, limiter instead (see
+// limitRate and the routes).
 func (app *application) rateLimit(next http.Handler) http.Handler {
+	limited := app.limitRate(app.config.limiter.rps, app.config.limiter.burst, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.Path == "/v1/coins/suggest" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limited.ServeHTTP(w, r)
+	})
+}
+
+// limitRate limits each client IP address to rps requests per second, with bursts of
+// up to burst requests. Each call creates an independent set of limiters, so different
+// parts of the API can be limited separately.
+func (app *application) limitRate(rps float64, burst int, next http.Handler) http.Handler {
+	// Only carry out the check if rate limiting is enabled.
+	if !app.config.limiter.enabled {
+		return next
+	}
+
 	// Define a client struct to hold the rate limiter and last seen time for each client.
 	type client struct {
 		limiter  *rate.Limiter
@@ -75,7 +100,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 		mu.Lock()
 		if _, found := clients[ip]; !found {
-			clients[ip] = &client{limiter: rate.NewLimiter(2, 4)}
+			clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(rps), burst)}
 		}
 
 		clients[ip].lastSeen = time.Now()
@@ -89,6 +114,7 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add the "Vary: Authorization" header to the response. This indicates to any
@@ -119,6 +145,26 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		}
 		// Extract the actual authentication token from the header parts.
 		token := headerParts[1]
+		// A signed access token carries everything that we need to know about the user,
+		// so it's verified without touching the database. The user in the context only
+		// has its ID and activation status set.
+		if app.signer != nil && signedtoken.LooksSigned(token) {
+			claims, err := app.signer.Verify(token, time.Now())
+			if err != nil || app.revoked.contains(claims.SessionID) {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			userID, err := strconv.ParseInt(claims.Subject, 10, 64)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+			r = app.contextSetUser(r, &data.User{ID: userID, Activated: claims.Activated})
+			r = app.contextSetSessionID(r, claims.SessionID)
+			r = app.contextSetPermissions(r, data.Permissions(claims.Permissions))
+			next.ServeHTTP(w, r)
+			return
+		}
 		// Validate the token to make sure it is in a sensible format.
 		v := validator.New()
 		// If the token isn't valid, use the invalidAuthenticationTokenResponse()
@@ -142,9 +188,22 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			}
 			return
 		}
+		// Record that the token has been used, which also gives us its family ID, so
+		// that handlers can tell which of the user's sessions the request belongs to.
+		sessionID, err := app.models.Tokens.Touch(token)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				app.invalidAuthenticationTokenResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
 		// Call the contextSetUser() helper to add the user information to the request
 		// context.
 		r = app.contextSetUser(r, user)
+		r = app.contextSetSessionID(r, sessionID)
 		// Call the next handler in the chain.
 		next.ServeHTTP(w, r)
 	})
@@ -178,11 +237,16 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrieve the user from the request context.
 		user := app.contextGetUser(r)
-		// Get the slice of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		// Get the slice of permissions for the user, from the signed access token if the
+		// request was made with one, or otherwise from the database.
+		permissions, ok := app.contextGetPermissions(r)
+		if !ok {
+			var err error
+			permissions, err = app.models.Permissions.GetAllForUser(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 		// Check if the slice includes the required permission. If it doesn't, then
 		// return a 403 Forbidden response.
@@ -207,6 +271,9 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			for i := range app.config.cors.trustedOrigins {
 				if origin == app.config.cors.trustedOrigins[i] {
 					w.Header().Set("Access-Control-Allow-Origin", origin)
+					// Let browser clients read the ETag header, for use in conditional
+					// requests.
+					w.Header().Set("Access-Control-Expose-Headers", "ETag")
 					// Check if the request has the HTTP method OPTIONS and contains the
 					// "Access-Control-Request-Method" header. If it does, then we treat
 					// it as a preflight request.
@@ -214,7 +281,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 						// Set the necessary preflight response headers, as discussed
 						// previously.
 						w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+						w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, If-Match, If-None-Match")
 						// Write the headers along with a 200 OK status and return from
 						// the middleware with no further action.
 						w.WriteHeader(http.StatusOK)
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/jsonpatch"
+)
+
+// The media types for the two kinds of patch document accepted by updateCoinHandler.
+const (
+	mergePatchType = "application/merge-patch+json"
+	jsonPatchType  = "application/json-patch+json"
+)
+
+// coinDocument is the editable part of a coin, as the JSON document that patches are
+// applied to. Unlike data.Coin, none of its fields are omitted when empty, so that
+// every field has a path which JSON Patch operations can replace or test.
+type coinDocument struct {
+	Title          string      `json:"title"`
+	Year           int32       `json:"year"`
+	YearFrom       int32       `json:"year_from"`
+	YearTo         int32       `json:"year_to"`
+	Era            string      `json:"era"`
+	Country        string      `json:"country"`
+	Denomination   string      `json:"denomination"`
+	FaceValue      float64     `json:"face_value"`
+	Composition    string      `json:"composition"`
+	Weight         float64     `json:"weight"`
+	Diameter       float64     `json:"diameter"`
+	Mint           string      `json:"mint"`
+	Mintage        int64       `json:"mintage"`
+	CatalogueRefs  []string    `json:"catalogue_refs"`
+	Price          *data.Money `json:"price"`
+	PriceSource    string      `json:"price_source"`
+	Grade          string      `json:"grade"`
+	GradingService string      `json:"grading_service"`
+	CertNumber     string      `json:"cert_number"`
+	Designations   []string    `json:"designations"`
+	Legends        string      `json:"legends"`
+	Description    string      `json:"description"`
+	Genres         []string    `json:"genres"`
+}
+
+func newCoinDocument(coin *data.Coin) coinDocument {
+	// Use empty slices rather than nil, so that the arrays are present in the document
+	// for operations like {"op": "add", "path": "/genres/-"}.
+	nonNil := func(s []string) []string {
+		if s == nil {
+			return []string{}
+		}
+		return s
+	}
+	return coinDocument{
+		Title:          coin.Title,
+		Year:           coin.Year,
+		YearFrom:       coin.YearFrom,
+		YearTo:         coin.YearTo,
+		Era:            coin.Era,
+		Country:        coin.Country,
+		Denomination:   coin.Denomination,
+		FaceValue:      coin.FaceValue,
+		Composition:    coin.Composition,
+		Weight:         coin.Weight,
+		Diameter:       coin.Diameter,
+		Mint:           coin.Mint,
+		Mintage:        coin.Mintage,
+		CatalogueRefs:  nonNil(coin.CatalogueRefs),
+		Price:          coin.Price,
+		PriceSource:    coin.PriceSource,
+		Grade:          coin.Grade,
+		GradingService: coin.GradingService,
+		CertNumber:     coin.CertNumber,
+		Designations:   nonNil(coin.Designations),
+		Legends:        coin.Legends,
+		Description:    coin.Description,
+		Genres:         nonNil(coin.Genres),
+	}
+}
+
+// applyTo copies the document's fields into the coin. As with a plain JSON update, a
+// changed price is assumed to be a manual valuation unless the price source was changed
+// too, and removing the price removes its source.
+func (d coinDocument) applyTo(coin *data.Coin) {
+	priceChanged := fmt.Sprint(d.Price) != fmt.Sprint(coin.Price)
+	if priceChanged && d.PriceSource == coin.PriceSource {
+		d.PriceSource = data.PriceSourceManual
+	}
+	if d.Price == nil {
+		d.PriceSource = ""
+	}
+	coin.Title = d.Title
+	coin.Year = d.Year
+	coin.YearFrom = d.YearFrom
+	coin.YearTo = d.YearTo
+	coin.Era = d.Era
+	coin.Country = d.Country
+	coin.Denomination = d.Denomination
+	coin.FaceValue = d.FaceValue
+	coin.Composition = d.Composition
+	coin.Weight = d.Weight
+	coin.Diameter = d.Diameter
+	coin.Mint = d.Mint
+	coin.Mintage = d.Mintage
+	coin.CatalogueRefs = d.CatalogueRefs
+	coin.Price = d.Price
+	coin.PriceSource = d.PriceSource
+	coin.Grade = d.Grade
+	coin.GradingService = d.GradingService
+	coin.CertNumber = d.CertNumber
+	coin.Designations = d.Designations
+	coin.Legends = d.Legends
+	coin.Description = d.Description
+	coin.Genres = d.Genres
+}
+
+// The readCoinPatch() helper reads a JSON Merge Patch or JSON Patch document from the
+// request body and applies it to the coin. The patch is applied to a JSON copy of the
+// coin, and the coin itself is only changed once every operation has succeeded, so a
+// failed patch leaves it untouched.
+//
+// Problems with the request body itself are returned as an error, for a 400 Bad
+// Request response. Problems with the patch, like an operation on a path that doesn't
+// exist, a failed test operation or a value of the wrong type, are returned as
+// validation errors keyed by the operation (or field) that caused them.
+func (app *application) readCoinPatch(w http.ResponseWriter, r *http.Request, coin *data.Coin, mediaType string) (map[string]string, error) {
+	var body json.RawMessage
+	err := app.readJSON(w, r, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := toJSONValue(newCoinDocument(coin))
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case mergePatchType:
+		patch, err := decodeJSONValue(body)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := patch.(map[string]interface{}); !ok {
+			return nil, errors.New("body must contain a JSON object")
+		}
+		doc = jsonpatch.MergePatch(doc, patch)
+	case jsonPatchType:
+		var operations []jsonpatch.Operation
+		err := json.Unmarshal(body, &operations)
+		if err != nil {
+			return nil, errors.New("body must contain a JSON array of patch operations")
+		}
+		doc, err = jsonpatch.Apply(doc, operations)
+		if err != nil {
+			var opErr *jsonpatch.OperationError
+			if errors.As(err, &opErr) {
+				key := fmt.Sprintf("operations[%d]", opErr.Index)
+				return map[string]string{key: opErr.Err.Error()}, nil
+			}
+			return nil, err
+		}
+	default:
+		panic("unsupported patch media type: " + mediaType)
+	}
+
+	// Decode the patched document back into a coinDocument, which checks that only
+	// known fields remain and that each one has the right type.
+	js, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	var patched coinDocument
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&patched)
+	if err != nil {
+		var unmarshalTypeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &unmarshalTypeError) && unmarshalTypeError.Field != "":
+			return map[string]string{unmarshalTypeError.Field: "has the wrong JSON type"}, nil
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return map[string]string{field: "is not a coin field"}, nil
+		case errors.As(err, &unmarshalTypeError):
+			return nil, errors.New("patched document must be a JSON object")
+		case errors.Is(err, data.ErrInvalidMoneyFormat):
+			return map[string]string{"price": err.Error()}, nil
+		default:
+			return nil, err
+		}
+	}
+	patched.applyTo(coin)
+	return nil, nil
+}
+
+// toJSONValue converts a value to the generic form used by the jsonpatch package.
+func toJSONValue(v interface{}) (interface{}, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJSONValue(js)
+}
+
+func decodeJSONValue(js []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var value interface{}
+	err := dec.Decode(&value)
+	return value, err
+}
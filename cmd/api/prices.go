@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The listCoinPricesHandler() returns the price history for a coin. The from and to
+// query string parameters restrict the history to a date range, and the interval
+// parameter (day or month) aggregates it into periods for charting.
+func (app *application) listCoinPricesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input data.PriceHistoryQuery
+	v := validator.New()
+	qs := r.URL.Query()
+	input.From = app.readDate(qs, "from", v)
+	input.To = app.readDate(qs, "to", v)
+	input.Interval = app.readString(qs, "interval", "")
+
+	if data.ValidatePriceHistoryQuery(v, input); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Check that the coin exists, so that we can tell the difference between an unknown
+	// coin and one without any price history.
+	_, err = app.models.Coins.Get(id, "id")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	var env envelope
+	if input.Interval != "" {
+		aggregates, err := app.models.Prices.Aggregate(id, input)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env = envelope{"prices": aggregates, "interval": input.Interval}
+	} else {
+		prices, err := app.models.Prices.GetAllForCoin(id, input)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env = envelope{"prices": prices}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The attachPrices() helper loads the full price history for a set of coins with a
+// single query and adds it to each coin.
+func (app *application) attachPrices(coins ...*data.Coin) error {
+	if len(coins) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(coins))
+	for i, coin := range coins {
+		ids[i] = coin.ID
+	}
+	prices, err := app.models.Prices.GetAllForCoins(ids...)
+	if err != nil {
+		return err
+	}
+	for _, coin := range coins {
+		coin.Prices = prices[coin.ID]
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"mime"
+	"net/http"
+
+	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The loadRatesHandler() reads an exchange rate file from the request body and stores
+// it as a new snapshot. The file can be CSV (Content-Type: text/csv) or JSON, and the
+// base currency and a description of where the rates came from are passed in the
+// query string.
+func (app *application) loadRatesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	snapshot := &data.RateSnapshot{
+		Base:   app.readString(qs, "base", ""),
+		Source: app.readString(qs, "source", "upload"),
+	}
+
+	maxBytes := 1_048_576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var rates map[string]*big.Rat
+	var err error
+	switch mediaType {
+	case "text/csv":
+		rates, err = data.ParseRatesCSV(r.Body)
+	case "application/json", "":
+		rates, err = data.ParseRatesJSON(r.Body)
+	default:
+		app.unsupportedMediaTypeResponse(w, r)
+		return
+	}
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	snapshot.Rates = rates
+
+	v := validator.New()
+	if data.ValidateRateSnapshot(v, snapshot); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Rates.Insert(snapshot)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"exchange_rates": snapshot, "rates": snapshot.RateStrings()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) showRatesHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := app.models.Rates.Latest()
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"exchange_rates": snapshot, "rates": snapshot.RateStrings()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The convertPrices() helper sets the ConvertedPrice field on each coin using the
+// latest exchange rate snapshot, and returns the snapshot so that the handler can
+// report which rates were used. Coins without a price, or priced in a currency that
+// isn't in the snapshot, are left unconverted.
+func (app *application) convertPrices(currency string, coins ...*data.Coin) (*data.RateSnapshot, error) {
+	snapshot, err := app.models.Rates.Latest()
+	if err != nil {
+		return nil, err
+	}
+	for _, coin := range coins {
+		if coin.Price == nil {
+			continue
+		}
+		converted, err := snapshot.Convert(*coin.Price, currency)
+		if err != nil {
+			if errors.Is(err, data.ErrUnknownRate) {
+				continue
+			}
+			return nil, err
+		}
+		coin.ConvertedPrice = &converted
+	}
+	return snapshot, nil
+}
+
+// The conversionErrorResponse() helper responds to an error from convertPrices(). If no
+// rates have been loaded we can't honour the currency parameter, which is reported as a
+// validation failure rather than a server error.
+func (app *application) conversionErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+		app.failedValidationResponse(w, r, map[string]string{"currency": "no exchange rates have been loaded"})
+	default:
+		app.serverErrorResponse(w, r, err)
+	}
+}
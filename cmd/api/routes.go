@@ -14,11 +14,58 @@ func (app *application) routes() http.Handler {
 	// Use the requirePermission() middleware on each of the /v1/coins** endpoints,
 	// passing in the required permission code as the first parameter.
 	router.HandlerFunc(http.MethodGet, "/v1/coins", app.requirePermission("coins:read", app.listCoinsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/coins", app.requirePermission("coins:write", app.createCoinHandler))
+	// POST /v1/coins/:id/images means that POST /v1/coins/import and /v1/coins/batch have
+	// to be dispatched from a POST /v1/coins/:id route too. There's no POST method for an
+	// actual coin.
+	router.HandlerFunc(http.MethodPost, "/v1/coins/:id", app.staticSegments("id", map[string]http.Handler{
+		"import": app.requirePermission("coins:write", app.importCoinsHandler),
+		"batch":  app.requirePermission("coins:write", app.batchCoinsHandler),
+	}, app.methodNotAllowedResponse))
+	// httprouter doesn't allow a static segment like "suggest" in the same position as
+	// the :id parameter, so the suggestions and export endpoints are dispatched from the
+	// :id route.
+	suggest := app.limitRate(app.config.limiter.suggestRPS, app.config.limiter.suggestBurst, app.requirePermission("coins:read", app.suggestCoinsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/coins/:id", app.staticSegments("id", map[string]http.Handler{
+		"suggest": suggest,
+		"export":  app.requirePermission("coins:read", app.exportCoinsHandler),
+	}, app.requirePermission("coins:read", app.showCoinHandler)))
+	router.HandlerFunc(http.MethodGet, "/v1/coins/:id/prices", app.requirePermission("coins:read", app.listCoinPricesHandler))
 	router.HandlerFunc(http.MethodPatch, "/v1/coins/:id", app.requirePermission("coins:write", app.updateCoinHandler))
 	router.HandlerFunc(http.MethodDelete, "/v1/coins/:id", app.requirePermission("coins:write", app.deleteCoinHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/coins/:id/images", app.requirePermission("coins:read", app.listCoinImagesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/coins/:id/images", app.requirePermission("coins:write", app.uploadCoinImageHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/coins/:id/images/:image_id", app.requirePermission("coins:write", app.deleteCoinImageHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/files/*key", app.showFileHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/rates", app.requirePermission("coins:read", app.showRatesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/rates", app.requirePermission("rates:write", app.loadRatesHandler))
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHandler)
+	router.HandlerFunc(http.MethodPut, "/v1/users/password", app.updateUserPasswordHandler)
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/refresh", app.refreshTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/tokens", app.requireAuthenticatedUser(app.listTokensHandler))
+	// DELETE /v1/tokens/current is dispatched from the :id route, like the static coin
+	// endpoints above.
+	router.HandlerFunc(http.MethodDelete, "/v1/tokens/:id", app.requireAuthenticatedUser(app.staticSegments("id", map[string]http.Handler{
+		"current": http.HandlerFunc(app.deleteCurrentTokenHandler),
+	}, app.deleteTokenHandler)))
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/activation", app.createActivationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/password-reset", app.createPasswordResetTokenHandler)
 	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 
 }
+
+// staticSegments returns a handler which dispatches to one of the static handlers when
+// the named route parameter matches its key exactly, and to next otherwise. It lets a
+// route like /v1/coins/suggest live alongside /v1/coins/:id.
+func (app *application) staticSegments(param string, static map[string]http.Handler, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params := httprouter.ParamsFromContext(r.Context())
+		if h, ok := static[params.ByName(param)]; ok {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
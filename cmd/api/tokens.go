@@ -2,10 +2,15 @@ package main
 
 import (
 	"errors"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"greenlight.alexedwards.net/internal/data"
+	"greenlight.alexedwards.net/internal/signedtoken"
 	"greenlight.alexedwards.net/internal/validator"
 )
 
@@ -54,16 +59,396 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
-	// Otherwise, if the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'.
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// Otherwise, if the password is correct, we start a new session with a short-lived
+	// authentication token and a long-lived refresh token, which the client exchanges
+	// for new tokens at POST /v1/tokens/refresh.
+	userAgent, ip := clientDetails(r)
+	access, refresh, err := app.models.Tokens.NewSession(user.ID, app.storedAccessTTL(), app.config.tokens.refreshTTL, userAgent, ip)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
-	// Encode the token to JSON and send it in the response along with a 201 Created
+	if access == nil {
+		access, err = app.signAccessToken(user, refresh.FamilyID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+	// Encode the tokens to JSON and send them in the response along with a 201 Created
 	// status code.
-	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": token}, nil)
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// refreshTokenHandler exchanges a refresh token for a new authentication token and a new
+// refresh token. The old refresh token can't be used again: presenting it a second time
+// revokes the whole session, because it means that the token has been copied.
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	v.Check(input.RefreshToken != "", "refresh_token", "must be provided")
+	v.Check(len(input.RefreshToken) == 26, "refresh_token", "must be 26 bytes long")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	userAgent, ip := clientDetails(r)
+	access, refresh, err := app.models.Tokens.Rotate(input.RefreshToken, app.storedAccessTTL(), app.config.tokens.refreshTTL, userAgent, ip)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTokenReused):
+			// The session's stored tokens are gone, and its signed access tokens,
+			// which may have been issued to the thief, are revoked too.
+			app.revoked.add(app.config.tokens.accessTTL, refresh.FamilyID)
+			app.logger.PrintInfo("refresh token reused, session revoked", map[string]string{"ip": ip})
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if access == nil {
+		// Read the user again, so that the signed token has their current activation
+		// status and permissions.
+		user, err := app.models.Users.Get(refresh.UserID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		access, err = app.signAccessToken(user, refresh.FamilyID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"authentication_token": access, "refresh_token": refresh}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// storedAccessTTL returns the lifetime of the access tokens stored in the database. In
+// stateless mode access tokens are signed instead, and it's zero.
+func (app *application) storedAccessTTL() time.Duration {
+	if app.config.auth.mode == "stateless" {
+		return 0
+	}
+	return app.config.tokens.accessTTL
+}
+
+// signAccessToken creates a signed access token for the user in the session, holding
+// their current permissions. Unlike a stored token, it isn't looked up on each request,
+// so changes to the user's permissions only take effect once it expires, which is why
+// access tokens should be short-lived. Logging out is handled by revokedSessions.
+func (app *application) signAccessToken(user *data.User, sessionID int64) (*data.Token, error) {
+	permissions, err := app.models.Permissions.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	expiry := now.Add(app.config.tokens.accessTTL).Truncate(time.Second)
+	plaintext, err := app.signer.Sign(signedtoken.Claims{
+		Subject:     strconv.FormatInt(user.ID, 10),
+		SessionID:   sessionID,
+		Activated:   user.Activated,
+		Permissions: permissions,
+		IssuedAt:    now.Unix(),
+		Expiry:      expiry.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &data.Token{Plaintext: plaintext, UserID: user.ID, Expiry: expiry, Scope: data.ScopeAuthentication}, nil
+}
+
+// revokedSessions is a denylist of the sessions which have been logged out or revoked,
+// so that the signed access tokens already issued for them stop working straight away
+// rather than when they expire. A session only needs to stay on the list for as long
+// as one of its access tokens could still be valid, so the list stays small.
+//
+// The list is held in memory, like the rate limiter's clients, so when the API runs as
+// several instances a revocation only takes effect at once on the instance that handled
+// it; on the others the tokens last until they expire.
+type revokedSessions struct {
+	mu       sync.Mutex
+	sessions map[int64]time.Time
+}
+
+func newRevokedSessions() *revokedSessions {
+	return &revokedSessions{sessions: make(map[int64]time.Time)}
+}
+
+// add puts the sessions on the denylist until ttl has passed, and clears out any
+// entries whose tokens have all expired.
+func (rs *revokedSessions) add(ttl time.Duration, sessionIDs ...int64) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	now := time.Now()
+	for id, until := range rs.sessions {
+		if now.After(until) {
+			delete(rs.sessions, id)
+		}
+	}
+	for _, id := range sessionIDs {
+		rs.sessions[id] = now.Add(ttl)
+	}
+}
+
+// contains reports whether the session has been revoked.
+func (rs *revokedSessions) contains(sessionID int64) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	until, ok := rs.sessions[sessionID]
+	return ok && time.Now().Before(until)
+}
+
+// clientDetails returns the user agent and IP address of the client that made the
+// request, for recording against a new session. Very long user agents are truncated.
+func clientDetails(r *http.Request) (userAgent, ip string) {
+	userAgent = r.UserAgent()
+	if len(userAgent) > 500 {
+		userAgent = strings.ToValidUTF8(userAgent[:500], "")
+	}
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return userAgent, ip
+}
+
+// listTokensHandler lists the sessions that the user is logged in with. The session
+// that made the request is marked as current.
+func (app *application) listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	sessions, err := app.models.Tokens.GetSessionsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	current := app.contextGetSessionID(r)
+	for _, session := range sessions {
+		session.Current = session.ID == current
+	}
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteCurrentTokenHandler logs out by revoking the session that the request was made
+// with, including its refresh token and any signed access tokens issued for it.
+func (app *application) deleteCurrentTokenHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	sessionID := app.contextGetSessionID(r)
+	err := app.models.Tokens.DeleteSession(user.ID, sessionID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.revoked.add(app.config.tokens.accessTTL, sessionID)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "you have been logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteTokenHandler revokes one of the user's sessions by its ID, to log out somewhere
+// else.
+func (app *application) deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+	user := app.contextGetUser(r)
+	err = app.models.Tokens.DeleteSession(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.revoked.add(app.config.tokens.accessTTL, id)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "session successfully revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// activationResendInterval is the minimum time between activation emails to the same
+// address, so that the endpoint below can't be used to flood someone's inbox.
+const activationResendInterval = 5 * time.Minute
+
+// createActivationTokenHandler emails a new activation token to a user whose welcome
+// email went missing. The response is the same whether or not the email address belongs
+// to an account that's waiting to be activated, and whether or not an email was
+// actually sent, so it can't be used to find out which addresses have accounts.
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	env := envelope{"message": "if this email address belongs to an account that hasn't been activated yet, an email will be sent to it containing activation instructions"}
+
+	// Only send an email if the account exists, hasn't already been activated and
+	// hasn't been sent an activation token in the last few minutes. In every other case
+	// just send the same response.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	send := !user.Activated
+	if send {
+		lastIssued, err := app.models.Tokens.LastIssued(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		send = time.Since(lastIssued) >= activationResendInterval
+	}
+	if send {
+		// Delete the user's old activation tokens, so that only the newest one works,
+		// and then create a new one.
+		err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// Email the user with their additional activation token.
+		app.background(func() {
+			data := map[string]interface{}{
+				"activationToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "token_activation.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// passwordResetResendInterval is the minimum time between password reset emails to the
+// same address, for the same reason as activationResendInterval.
+const passwordResetResendInterval = 5 * time.Minute
+
+// createPasswordResetTokenHandler emails a short-lived password reset token to the
+// user with the given email address. Like createActivationTokenHandler, the response
+// is the same whether or not an email was sent, so it can't be used to find out which
+// addresses have accounts.
+func (app *application) createPasswordResetTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// Parse and validate the user's email address.
+	var input struct {
+		Email string `json:"email"`
+	}
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+	v := validator.New()
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+	env := envelope{"message": "if this email address belongs to an activated account, an email will be sent to it containing password reset instructions"}
+
+	// Only send an email if the account exists, has been activated and hasn't been sent
+	// a password reset token in the last few minutes. In every other case just send the
+	// same response.
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			err = app.writeJSON(w, http.StatusAccepted, env, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	send := user.Activated
+	if send {
+		lastIssued, err := app.models.Tokens.LastIssued(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		send = time.Since(lastIssued) >= passwordResetResendInterval
+	}
+	if send {
+		// Create a new password reset token with a 45-minute expiry time.
+		token, err := app.models.Tokens.New(user.ID, 45*time.Minute, data.ScopePasswordReset)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		// Email the user with their password reset token.
+		app.background(func() {
+			data := map[string]interface{}{
+				"passwordResetToken": token.Plaintext,
+			}
+			err := app.mailer.Send(user.Email, "token_password_reset.tmpl", data)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		})
+	}
+
+	// Send a 202 Accepted response and confirmation message to the client.
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
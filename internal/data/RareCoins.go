@@ -4,6 +4,9 @@ import (
 	"context" // New import
 	"database/sql"
 	"fmt"
+	"html"
+	"slices"
+	"strings"
 	"time"
 
 	"errors"
@@ -13,67 +16,411 @@ import (
 )
 
 type Coin struct {
-	ID        int64     `json:"id"`
-	CreatedAt time.Time `json:"-"`
-	Title     string    `json:"title"`
-	Year      int32     `json:"year,omitempty"`
-	Runtime   int32     `json:"runtime,omitempty"`
-	Genres    []string  `json:"genres,omitempty"`
-	Version   int32     `json:"version"`
+	ID             int64        `json:"id"`
+	CreatedAt      time.Time    `json:"-"`
+	Title          string       `json:"title"`
+	Year           int32        `json:"year,omitempty"`      // Negative for BCE, 0 when undated.
+	YearFrom       int32        `json:"year_from,omitempty"` // Start of a "circa" date range.
+	YearTo         int32        `json:"year_to,omitempty"`   // End of a "circa" date range.
+	Era            string       `json:"era,omitempty"`       // Regnal year or era label.
+	Country        string       `json:"country"`
+	Denomination   string       `json:"denomination"`
+	FaceValue      float64      `json:"face_value"`
+	Composition    string       `json:"composition,omitempty"`
+	Weight         float64      `json:"weight,omitempty"`   // In grams.
+	Diameter       float64      `json:"diameter,omitempty"` // In millimetres.
+	Mint           string       `json:"mint,omitempty"`
+	Mintage        int64        `json:"mintage,omitempty"`
+	CatalogueRefs  []string     `json:"catalogue_refs,omitempty"`
+	Price          *Money       `json:"price,omitempty"`
+	PriceSource    string       `json:"price_source,omitempty"`
+	ConvertedPrice *Money       `json:"converted_price,omitempty"` // Not stored; set by ?currency=.
+	Grade          string       `json:"grade,omitempty"`           // Sheldon grade, like "MS-65".
+	GradingService string       `json:"grading_service,omitempty"`
+	CertNumber     string       `json:"cert_number,omitempty"`
+	Designations   []string     `json:"designations,omitempty"`
+	Genres         []string     `json:"genres,omitempty"`
+	Legends        string       `json:"legends,omitempty"` // Inscriptions on the coin.
+	Description    string       `json:"description,omitempty"`
+	Images         []*CoinImage `json:"images,omitempty"`  // Not stored in the coins table.
+	Prices         []*CoinPrice `json:"prices,omitempty"`  // Not stored; set by ?include=prices.
+	Snippet        string       `json:"snippet,omitempty"` // Not stored; set by ?highlight=.
+	Version        int32        `json:"version"`
 }
 
 func ValidateCoin(v *validator.Validator, coin *Coin) {
 	v.Check(coin.Title != "", "title", "must be provided")
 	v.Check(len(coin.Title) <= 500, "title", "must not be more than 500 bytes long")
-	v.Check(coin.Year != 0, "year", "must be provided")
-	v.Check(coin.Year >= 1888, "year", "must be greater than 1888")
-	v.Check(coin.Year <= int32(time.Now().Year()), "year", "must not be in the future")
+	// A coin is either dated with an exact year or attributed to a "circa" range of
+	// years (or both, in which case the exact year must fall inside the range).
+	if coin.YearFrom != 0 || coin.YearTo != 0 {
+		v.Check(coin.YearFrom != 0, "year_from", "must be provided with year_to")
+		v.Check(coin.YearTo != 0, "year_to", "must be provided with year_from")
+		validateYear(v, "year_from", coin.YearFrom)
+		validateYear(v, "year_to", coin.YearTo)
+		v.Check(coin.YearFrom <= coin.YearTo, "year_to", "must not be before year_from")
+		if coin.Year != 0 {
+			v.Check(coin.Year >= coin.YearFrom && coin.Year <= coin.YearTo, "year", "must be within year_from and year_to")
+		}
+	} else {
+		v.Check(coin.Year != 0, "year", "must be provided")
+	}
+	validateYear(v, "year", coin.Year)
+	v.Check(len(coin.Era) <= 200, "era", "must not be more than 200 bytes long")
+	v.Check(coin.Country != "", "country", "must be provided")
+	v.Check(len(coin.Country) <= 100, "country", "must not be more than 100 bytes long")
+	v.Check(coin.Denomination != "", "denomination", "must be provided")
+	v.Check(len(coin.Denomination) <= 100, "denomination", "must not be more than 100 bytes long")
+	v.Check(coin.FaceValue >= 0, "face_value", "must not be negative")
+	v.Check(len(coin.Composition) <= 200, "composition", "must not be more than 200 bytes long")
+	v.Check(coin.Weight >= 0, "weight", "must not be negative")
+	v.Check(coin.Weight <= 100_000, "weight", "must not be more than 100000 grams")
+	v.Check(coin.Diameter >= 0, "diameter", "must not be negative")
+	v.Check(coin.Diameter <= 1_000, "diameter", "must not be more than 1000 millimetres")
+	v.Check(len(coin.Mint) <= 200, "mint", "must not be more than 200 bytes long")
+	v.Check(coin.Mintage >= 0, "mintage", "must not be negative")
+	v.Check(len(coin.CatalogueRefs) <= 10, "catalogue_refs", "must not contain more than 10 references")
+	v.Check(validator.Unique(coin.CatalogueRefs), "catalogue_refs", "must not contain duplicate values")
+	if coin.Price != nil {
+		ValidateMoney(v, "price", *coin.Price)
+		v.Check(validator.In(coin.PriceSource, PriceSources...), "price_source", "must be one of dealer_quote, auction_result or manual")
+	}
+	ValidateGrading(v, coin)
+	v.Check(len(coin.Legends) <= 2000, "legends", "must not be more than 2000 bytes long")
+	v.Check(len(coin.Description) <= 20000, "description", "must not be more than 20000 bytes long")
 	v.Check(coin.Genres != nil, "genres", "must be provided")
 	v.Check(len(coin.Genres) >= 1, "genres", "must contain at least 1 genre")
 	v.Check(len(coin.Genres) <= 5, "genres", "must not contain more than 5 genres")
 	v.Check(validator.Unique(coin.Genres), "genres", "must not contain duplicate values")
 }
 
+// MinCoinYear is the earliest year accepted for a coin. The first struck coins date
+// from around the 7th century BCE, so this leaves some room for early Lydian issues.
+const MinCoinYear = -1000
+
+// validateYear checks a signed year value. Years are astronomical-style signed integers
+// with negative values for BCE, except that there is no year 0 --- a zero value means
+// the year hasn't been provided and is skipped.
+func validateYear(v *validator.Validator, key string, year int32) {
+	if year == 0 {
+		return
+	}
+	v.Check(year >= MinCoinYear, key, fmt.Sprintf("must not be earlier than %d", MinCoinYear))
+	v.Check(year <= int32(time.Now().Year()), key, "must not be in the future")
+}
+
+// CoinQuery holds the coin-specific criteria used to filter the results of GetAll().
+// Zero values mean that the corresponding criterion isn't applied.
+type CoinQuery struct {
+	Title            string
+	Search           string // Full-text search across title, legends, country and description.
+	Language         string // Text search configuration used for Search.
+	SearchMode       string // "fulltext" (the default) or "fuzzy".
+	Highlight        bool   // Include a highlighted snippet of the matching text.
+	Genres           []string
+	GenresMatch      string // Match "all" of Genres (the default) or "any" of them.
+	ExcludeGenres    []string
+	ExcludeCountries []string
+	YearMin          int32
+	YearMax          int32
+	PriceMin         *Money
+	PriceMax         *Money
+	GradeMin         int
+	GradeMax         int
+	CreatedFrom      time.Time // Inclusive date.
+	CreatedTo        time.Time // Inclusive date.
+}
+
+// SearchLanguages lists the PostgreSQL text search configurations that clients can
+// choose for full-text search. "simple" doesn't do any stemming, which suits legends in
+// Latin and other languages without a configuration of their own.
+var SearchLanguages = []string{"simple", "english", "french", "german", "spanish", "italian", "portuguese", "dutch", "russian"}
+
+func ValidateCoinQuery(v *validator.Validator, q CoinQuery) {
+	v.Check(len(q.Search) <= 500, "q", "must not be more than 500 bytes long")
+	v.Check(validator.In(q.Language, SearchLanguages...), "language", "invalid language value")
+	v.Check(validator.In(q.SearchMode, "fulltext", "fuzzy"), "search_mode", "must be fulltext or fuzzy")
+	validateYear(v, "year_min", q.YearMin)
+	validateYear(v, "year_max", q.YearMax)
+	if q.YearMin != 0 && q.YearMax != 0 {
+		v.Check(q.YearMin <= q.YearMax, "year_max", "must not be less than year_min")
+	}
+	if q.PriceMin != nil {
+		ValidateMoney(v, "price_min", *q.PriceMin)
+	}
+	if q.PriceMax != nil {
+		ValidateMoney(v, "price_max", *q.PriceMax)
+	}
+	if q.GradeMin != 0 {
+		v.Check(q.GradeMin >= 1 && q.GradeMin <= 70, "grade_min", "must be between 1 and 70")
+	}
+	if q.GradeMax != 0 {
+		v.Check(q.GradeMax >= 1 && q.GradeMax <= 70, "grade_max", "must be between 1 and 70")
+	}
+	if q.GradeMin != 0 && q.GradeMax != 0 {
+		v.Check(q.GradeMin <= q.GradeMax, "grade_max", "must not be less than grade_min")
+	}
+	if q.PriceMin != nil && q.PriceMax != nil {
+		v.Check(q.PriceMin.Currency == q.PriceMax.Currency, "price_max", "must use the same currency as price_min")
+		v.Check(q.PriceMin.Amount <= q.PriceMax.Amount, "price_max", "must not be less than price_min")
+	}
+	if !q.CreatedFrom.IsZero() && !q.CreatedTo.IsZero() {
+		v.Check(!q.CreatedTo.Before(q.CreatedFrom), "created_to", "must not be before created_from")
+	}
+	validateCoinQueryLists(v, q)
+}
+
+// createdRange returns the created_at bounds as arguments for a half-open range
+// [from, to), with nil for an open end. To is moved forward a day so that it's inclusive.
+func (q CoinQuery) createdRange() (interface{}, interface{}) {
+	var from, to interface{}
+	if !q.CreatedFrom.IsZero() {
+		from = q.CreatedFrom
+	}
+	if !q.CreatedTo.IsZero() {
+		to = q.CreatedTo.AddDate(0, 0, 1)
+	}
+	return from, to
+}
+
+// validateCoinQueryLists checks the multi-value genre and country filters.
+func validateCoinQueryLists(v *validator.Validator, q CoinQuery) {
+	v.Check(validator.In(q.GenresMatch, "all", "any"), "genres_match", "must be all or any")
+	v.Check(len(q.Genres) <= 20, "genres", "must not contain more than 20 values")
+	v.Check(len(q.ExcludeGenres) <= 20, "exclude_genres", "must not contain more than 20 values")
+	v.Check(len(q.ExcludeCountries) <= 20, "exclude_countries", "must not contain more than 20 values")
+	for _, genre := range q.ExcludeGenres {
+		v.Check(!validator.In(genre, q.Genres...), "exclude_genres", "must not contain a genre that is also in genres")
+	}
+}
+
+// priceBound returns the currency and amount of an optional price filter as query
+// arguments, with an empty currency meaning that the filter isn't applied.
+func priceBound(m *Money) (string, int64) {
+	if m == nil {
+		return "", 0
+	}
+	return m.Currency, m.Amount
+}
+
 type CoinModel struct {
 	DB *sql.DB
 }
 
-// Add a placeholder method for inserting a new record in the coins table.
+// insertCoinQuery adds a coin and, if it has a price, the first entry in its price
+// history, in a single statement.
+const insertCoinQuery = `
+	WITH coin AS (
+		INSERT INTO coins (title, year, year_from, year_to, era, country, denomination,
+			face_value, composition, weight, diameter, mint, mintage, catalogue_refs, price,
+			price_source, grade, grading_service, cert_number, designations, legends, description,
+			genres)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18,
+			$19, $20, $21, $22, $23)
+		RETURNING id, created_at, version, price, price_source
+	), history AS (
+		INSERT INTO coin_prices (coin_id, price, source)
+		SELECT id, price, price_source FROM coin WHERE price IS NOT NULL
+	)
+	SELECT id, created_at, version FROM coin`
+
+// emptyIfNil returns an empty slice in place of a nil one. The array columns are NOT
+// NULL, so a nil slice (for a field that the client left out, or cleared in a patch)
+// has to be sent as an empty array rather than as NULL.
+func emptyIfNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// insertArgs returns the arguments for insertCoinQuery.
+func (coin *Coin) insertArgs() []interface{} {
+	return []interface{}{
+		coin.Title,
+		coin.Year,
+		coin.YearFrom,
+		coin.YearTo,
+		coin.Era,
+		coin.Country,
+		coin.Denomination,
+		coin.FaceValue,
+		coin.Composition,
+		coin.Weight,
+		coin.Diameter,
+		coin.Mint,
+		coin.Mintage,
+		pq.Array(emptyIfNil(coin.CatalogueRefs)),
+		coin.Price,
+		coin.PriceSource,
+		coin.Grade,
+		coin.GradingService,
+		coin.CertNumber,
+		pq.Array(emptyIfNil(coin.Designations)),
+		coin.Legends,
+		coin.Description,
+		pq.Array(emptyIfNil(coin.Genres)),
+	}
+}
+
+// Insert adds a new coin. If the coin has a price, it's recorded as the first entry in
+// the coin's price history in the same statement.
 func (m CoinModel) Insert(coin *Coin) error {
-	query := `
-	INSERT INTO coins (title, year, runtime, genres)
-	VALUES ($1, $2, $3, $4)
-	RETURNING id, created_at, version`
-	args := []interface{}{coin.Title, coin.Year, coin.Runtime, pq.Array(coin.Genres)}
-	// Create a context with a 3-second timeout.
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	// Use QueryRowContext() and pass the context as the first argument.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&coin.ID, &coin.CreatedAt, &coin.Version)
+	return insertCoin(ctx, m.DB, coin)
 }
-func (m CoinModel) Get(id int64) (*Coin, error) {
+
+// dbtx is implemented by both *sql.DB and *sql.Tx, so that the statements which change
+// coins can be run on their own or as part of a batch transaction.
+type dbtx interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertCoin(ctx context.Context, db dbtx, coin *Coin) error {
+	// Use QueryRowContext() and pass the context as the first argument. A violation of
+	// the "coins_grading_service_cert_number_key" index means that the slab has already
+	// been registered against another coin.
+	err := db.QueryRowContext(ctx, insertCoinQuery, coin.insertArgs()...).Scan(&coin.ID, &coin.CreatedAt, &coin.Version)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "coins_grading_service_cert_number_key"`:
+			return ErrDuplicateCertificate
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// InsertBatch adds a batch of coins in a single transaction. Each coin is inserted
+// under its own savepoint, so that a coin which duplicates an existing certificate can
+// be skipped without losing the rest of the batch: those coins are reported in the
+// returned map, keyed by their index in the batch. Any other error aborts the whole
+// batch.
+func (m CoinModel) InsertBatch(coins []*Coin) (map[int]error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	skipped := make(map[int]error)
+	for i, coin := range coins {
+		_, err = tx.ExecContext(ctx, "SAVEPOINT batch_coin")
+		if err != nil {
+			return nil, err
+		}
+		err = insertCoin(ctx, tx, coin)
+		if err != nil {
+			if !errors.Is(err, ErrDuplicateCertificate) {
+				return nil, err
+			}
+			skipped[i] = err
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_coin")
+		} else {
+			_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_coin")
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return skipped, tx.Commit()
+}
+
+// The kinds of operation in a batch.
+const (
+	OpCreate = "create"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// CoinOperation is one operation in a batch. Creates and updates save the coin, with
+// updates using its version number for optimistic locking. Deletes only use the coin's
+// ID and Version, and always check the version. ApplyBatch sets Err if the operation
+// fails.
+type CoinOperation struct {
+	Op   string
+	Coin *Coin
+	Err  error
+}
+
+// ApplyBatch applies a batch of operations in a single transaction.
+//
+// In atomic mode, the batch stops at the first operation that fails, and nothing is
+// committed: the failed operation has its Err set, and the operations before it should
+// be treated as not applied. Otherwise, each operation runs under its own savepoint, so
+// that a failed operation is rolled back and reported in its Err without affecting the
+// rest of the batch.
+//
+// Only the errors that an operation is expected to fail with (ErrDuplicateCertificate,
+// ErrEditConflict and ErrRecordNotFound) are reported per operation. Any other error
+// aborts the whole batch and is returned.
+func (m CoinModel) ApplyBatch(ops []*CoinOperation, atomic bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, op := range ops {
+		if !atomic {
+			_, err = tx.ExecContext(ctx, "SAVEPOINT batch_operation")
+			if err != nil {
+				return err
+			}
+		}
+		switch op.Op {
+		case OpCreate:
+			op.Err = insertCoin(ctx, tx, op.Coin)
+		case OpUpdate:
+			op.Err = updateCoin(ctx, tx, op.Coin)
+		case OpDelete:
+			op.Err = deleteCoin(ctx, tx, op.Coin.ID, op.Coin.Version)
+		default:
+			panic("unknown batch operation: " + op.Op)
+		}
+		switch {
+		case op.Err == nil:
+			if !atomic {
+				_, err = tx.ExecContext(ctx, "RELEASE SAVEPOINT batch_operation")
+			}
+		case errors.Is(op.Err, ErrDuplicateCertificate), errors.Is(op.Err, ErrEditConflict), errors.Is(op.Err, ErrRecordNotFound):
+			if atomic {
+				return nil
+			}
+			_, err = tx.ExecContext(ctx, "ROLLBACK TO SAVEPOINT batch_operation")
+		default:
+			return op.Err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get returns the coin with the given id. If any fields are given, only those columns
+// (and the id and version) are read from the database, and the rest of the coin is left zero.
+func (m CoinModel) Get(id int64, fields ...string) (*Coin, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
-	// Remove the pg_sleep(10) clause.
-	query := `
-	SELECT id, created_at, title, year, runtime, genres, version
+	columns, dests := selectCoinColumns(fields)
+	query := fmt.Sprintf(`
+	SELECT %s
 	FROM coins
-	WHERE id = $1`
+	WHERE id = $1`, columns)
 	var coin Coin
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	// Remove &[]byte{} from the first Scan() destination.
-	err := m.DB.QueryRowContext(ctx, query, id).Scan(
-		&coin.ID,
-		&coin.CreatedAt,
-		&coin.Title,
-		&coin.Year,
-		&coin.Runtime,
-		pq.Array(&coin.Genres),
-		&coin.Version,
-	)
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(dests(&coin)...)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
@@ -84,28 +431,73 @@ func (m CoinModel) Get(id int64) (*Coin, error) {
 	}
 	return &coin, nil
 }
+
+// Update saves the coin, using the version number for optimistic locking. If the price
+// differs from the latest entry in the coin's price history, then a new history entry
+// is recorded in the same statement, so that past valuations are never lost.
 func (m CoinModel) Update(coin *Coin) error {
+	// Create a context with a 3-second timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return updateCoin(ctx, m.DB, coin)
+}
+
+func updateCoin(ctx context.Context, db dbtx, coin *Coin) error {
 	query := `
-	UPDATE coins
-	SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
-	WHERE id = $5 AND version = $6
-	RETURNING version`
+	WITH coin AS (
+		UPDATE coins
+		SET title = $1, year = $2, year_from = $3, year_to = $4, era = $5, country = $6,
+			denomination = $7, face_value = $8, composition = $9, weight = $10, diameter = $11,
+			mint = $12, mintage = $13, catalogue_refs = $14, price = $15, price_source = $16,
+			grade = $17, grading_service = $18, cert_number = $19, designations = $20,
+			legends = $21, description = $22, genres = $23, version = version + 1
+		WHERE id = $24 AND version = $25
+		RETURNING id, version, price, price_source
+	), history AS (
+		INSERT INTO coin_prices (coin_id, price, source)
+		SELECT id, price, price_source FROM coin
+		WHERE price IS NOT NULL
+		AND price IS DISTINCT FROM (
+			SELECT coin_prices.price FROM coin_prices
+			WHERE coin_prices.coin_id = coin.id
+			ORDER BY coin_prices.recorded_at DESC, coin_prices.id DESC
+			LIMIT 1
+		)
+	)
+	SELECT version FROM coin`
 	args := []interface{}{
 		coin.Title,
 		coin.Year,
-		coin.Runtime,
-		pq.Array(coin.Genres),
+		coin.YearFrom,
+		coin.YearTo,
+		coin.Era,
+		coin.Country,
+		coin.Denomination,
+		coin.FaceValue,
+		coin.Composition,
+		coin.Weight,
+		coin.Diameter,
+		coin.Mint,
+		coin.Mintage,
+		pq.Array(emptyIfNil(coin.CatalogueRefs)),
+		coin.Price,
+		coin.PriceSource,
+		coin.Grade,
+		coin.GradingService,
+		coin.CertNumber,
+		pq.Array(emptyIfNil(coin.Designations)),
+		coin.Legends,
+		coin.Description,
+		pq.Array(emptyIfNil(coin.Genres)),
 		coin.ID,
 		coin.Version,
 	}
-	// Create a context with a 3-second timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-	// Use QueryRowContext() and pass the context as the first argument.
 	// Use QueryRowContext() and pass the context as the first argument.
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&coin.Version)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&coin.Version)
 	if err != nil {
 		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "coins_grading_service_cert_number_key"`:
+			return ErrDuplicateCertificate
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
@@ -114,18 +506,26 @@ func (m CoinModel) Update(coin *Coin) error {
 	}
 	return nil
 }
-func (m CoinModel) Delete(id int64) error {
+
+// Delete removes a coin. If version isn't zero, the coin is only deleted if it's still
+// at that version, and ErrEditConflict is returned if it isn't (or if it has been
+// deleted in the meantime).
+func (m CoinModel) Delete(id int64, version int32) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
-	query := `
-	DELETE FROM coins
-	WHERE id = $1`
 	// Create a context with a 3-second timeout.
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
+	return deleteCoin(ctx, m.DB, id, version)
+}
+
+func deleteCoin(ctx context.Context, db dbtx, id int64, version int32) error {
+	query := `
+	DELETE FROM coins
+	WHERE id = $1 AND (version = $2 OR $2 = 0)`
 	// Use ExecContext() and pass the context as the first argument.
-	result, err := m.DB.ExecContext(ctx, query, id)
+	result, err := db.ExecContext(ctx, query, id, version)
 	if err != nil {
 		return err
 	}
@@ -134,25 +534,190 @@ func (m CoinModel) Delete(id int64) error {
 		return err
 	}
 	if rowsAffected == 0 {
+		if version != 0 {
+			return ErrEditConflict
+		}
 		return ErrRecordNotFound
 	}
 	return nil
 }
 
-func (m CoinModel) GetAll(title string, genres []string, filters Filters) ([]*Coin, Metadata, error) {
+// coinSort returns the ORDER BY expression and direction for the filters' sort key,
+// and whether the sort can be used for keyset pagination.
+//
+// Sorting by year uses the generated year_start column, so that coins dated with a
+// "circa" range are ordered by the start of their range alongside exactly dated coins.
+//
+// Prices in different currencies can't be compared directly, so sorting by price groups
+// coins by currency first and then orders them by amount within each one. Currencies
+// are always in ascending order; the sort direction only applies to the amounts.
+//
+// Relevance is always sorted with the best matches first, using the rank expression
+// from coinFilter.
+func coinSort(filters Filters, rank string) (column, direction string, keyset bool) {
+	column = filters.sortColumn()
+	direction = filters.sortDirection()
+	// Keyset pagination needs a single, non-NULL sort column, which rules out sorting by
+	// price (two columns, and NULL for unpriced coins) and relevance (calculated).
+	keyset = column != "price" && column != "relevance"
+	switch column {
+	case "year":
+		column = "year_start"
+	case "price":
+		column = "(price).currency, (price).amount"
+	case "grade":
+		column = "grade_number"
+	case "relevance":
+		column, direction = rank, "DESC"
+	}
+	return column, direction, keyset
+}
+
+// coinFilter returns the FROM and WHERE clauses which select the coins matching the
+// query, and the expression which ranks them against the search term. The clauses use
+// the parameters $1 to $16, as returned by filterArgs.
+func coinFilter(q CoinQuery) (from, rank string) {
+	// In full-text mode, the stored search_vector column uses the "simple"
+	// configuration and is indexed. For any other language the weighted vector is
+	// calculated on the fly instead, so that the query is stemmed the same way as the
+	// text it's matched against.
+	//
+	// In fuzzy mode, the search term is matched against the words in the title and
+	// legends by trigram similarity, which copes with misspellings like "Morgn dolar".
+	var match string
+	switch q.SearchMode {
+	case "fuzzy":
+		match = "($12 <% title OR $12 <% legends)"
+		rank = "GREATEST(word_similarity($12, title), word_similarity($12, legends))"
+	default:
+		searchVector := "search_vector"
+		if q.Language != "simple" {
+			searchVector = `(setweight(to_tsvector($11::regconfig, title), 'A') ||
+			setweight(to_tsvector($11::regconfig, legends), 'B') ||
+			setweight(to_tsvector($11::regconfig, country), 'C') ||
+			setweight(to_tsvector($11::regconfig, description), 'D'))`
+		}
+		match = searchVector + " @@ query"
+		rank = "ts_rank(" + searchVector + ", query)"
+	}
+	// Genres can be matched with either the "contains" (@>) or the "overlaps" (&&)
+	// array operator. Like the sort column, the operator comes from a fixed list rather
+	// than the client, so it's safe to interpolate into the query.
+	genresOperator := "@>"
+	if q.GenresMatch == "any" {
+		genresOperator = "&&"
+	}
+	// The filtering clauses are shared by the list, facet and export queries, so that
+	// they all see exactly the same set of coins. The year range filter matches any coin
+	// whose date range overlaps the requested one. A NULL created_at bound leaves that
+	// end of the range open, and the exclusion filters don't exclude anything when
+	// they're given an empty array.
+	from = fmt.Sprintf(`
+	FROM coins, websearch_to_tsquery($11::regconfig, $12) AS query
+	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
+	AND (%s OR $12 = '')
+	AND (genres %s $2 OR $2 = '{}')
+	AND NOT (genres && $15)
+	AND country <> ALL($16)
+	AND (year_end >= $3 OR $3 = 0)
+	AND (year_start <= $4 OR $4 = 0)
+	AND ($5 = '' OR ((price).currency = $5 AND (price).amount >= $6))
+	AND ($7 = '' OR ((price).currency = $7 AND (price).amount <= $8))
+	AND (grade_number >= $9 OR $9 = 0)
+	AND (grade_number <= $10 OR $10 = 0)
+	AND (created_at >= $13 OR $13 IS NULL)
+	AND (created_at < $14 OR $14 IS NULL)`, match, genresOperator)
+	return from, rank
+}
+
+// filterArgs returns the parameters $1 to $16 used by the clauses from coinFilter.
+func (q CoinQuery) filterArgs() []interface{} {
+	priceMinCurrency, priceMinAmount := priceBound(q.PriceMin)
+	priceMaxCurrency, priceMaxAmount := priceBound(q.PriceMax)
+	createdFrom, createdTo := q.createdRange()
+	return []interface{}{
+		q.Title,
+		pq.Array(q.Genres),
+		q.YearMin,
+		q.YearMax,
+		priceMinCurrency,
+		priceMinAmount,
+		priceMaxCurrency,
+		priceMaxAmount,
+		q.GradeMin,
+		q.GradeMax,
+		q.Language,
+		q.Search,
+		createdFrom,
+		createdTo,
+		pq.Array(q.ExcludeGenres),
+		pq.Array(q.ExcludeCountries),
+	}
+}
+
+// markSnippet turns a ts_headline() snippet into HTML. The snippet is made from the raw
+// coin text, which mustn't be trusted as HTML, so ts_headline() marks the matches with
+// the control characters \x01 and \x02 instead of tags; the text is escaped and then
+// the markers are swapped for <mark> tags.
+func markSnippet(snippet string) string {
+	return strings.NewReplacer("\x01", "<mark>", "\x02", "</mark>").Replace(html.EscapeString(snippet))
+}
+
+func (m CoinModel) GetAll(q CoinQuery, filters Filters) ([]*Coin, Metadata, error) {
+	from, rank := coinFilter(q)
+	sortColumn, sortDirection, keyset := coinSort(filters, rank)
+	// With keyset pagination, the page starts immediately after (or, reading backwards,
+	// before) the row that the cursor points to, using a row comparison on the sort
+	// column and id. A Before cursor is read in reverse order and the page is flipped
+	// back round afterwards. Counting the total records would mean reading every
+	// matching row, which is exactly what keyset pagination avoids, so it's skipped.
+	//
+	// One extra row is fetched to find out whether there's another page after this one.
+	count, keysetCondition, orderDirection := "count(*) OVER()", "", sortDirection
+	if filters.SkipCount {
+		count = "0"
+	}
+	c, backwards, cursorMode := filters.cursor()
+	if cursorMode {
+		if !keyset {
+			panic("unsafe keyset sort: " + filters.Sort)
+		}
+		operator := ">"
+		if sortDirection == "DESC" {
+			operator = "<"
+		}
+		if backwards {
+			operator = map[string]string{">": "<", "<": ">"}[operator]
+			orderDirection = map[string]string{"ASC": "DESC", "DESC": "ASC"}[sortDirection]
+		}
+		count = "0"
+		keysetCondition = fmt.Sprintf("AND (%s, id) %s ($20, $21)", sortColumn, operator)
+	}
+	columns, dests := selectCoinColumns(filters.Fields)
+	sortKey := "''"
+	if keyset {
+		sortKey = sortColumn + "::text"
+	}
 	// Update the SQL query to include the window function which counts the total
 	// (filtered) records.
-	// (filtered) records.
 	query := fmt.Sprintf(`
-	SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version
-	FROM coins
-	WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
-	AND (genres @> $2 OR $2 = '{}')
-	ORDER BY %s %s, id ASC
-	LIMIT $3 OFFSET $4`, filters.sortColumn(), filters.sortDirection())
+	SELECT %s, %s,
+		CASE WHEN $17 AND $12 <> '' THEN ts_headline($11::regconfig,
+			concat_ws(' ... ', title, NULLIF(legends, ''), NULLIF(description, '')), query,
+			'StartSel=' || chr(1) || ', StopSel=' || chr(2) || ', MaxFragments=2, MaxWords=20, MinWords=5')
+		ELSE '' END,
+		%s
+	%s
+	%s
+	ORDER BY %s %s, id %[7]s
+	LIMIT $18 OFFSET $19`, count, columns, sortKey, from, keysetCondition, sortColumn, orderDirection)
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	args := []interface{}{title, pq.Array(genres), filters.limit(), filters.offset()}
+	args := append(q.filterArgs(), q.Highlight, filters.limit()+1, filters.offset())
+	if cursorMode {
+		args[18] = 0
+		args = append(args, c.Key, c.ID)
+	}
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
@@ -161,29 +726,143 @@ func (m CoinModel) GetAll(title string, genres []string, filters Filters) ([]*Co
 	// Declare a totalRecords variable.
 	totalRecords := 0
 	coins := []*Coin{}
+	keys := []string{}
 	for rows.Next() {
 		var coin Coin
-		err := rows.Scan(
-			&totalRecords, // Scan the count from the window function into totalRecords.
-			&coin.ID,
-			&coin.CreatedAt,
-			&coin.Title,
-			&coin.Year,
-			&coin.Runtime,
-			pq.Array(&coin.Genres),
-			&coin.Version,
-		)
+		var key string
+		// Scan the count from the window function into totalRecords, followed by the
+		// selected coin columns, the snippet and the sort key.
+		dest := append([]interface{}{&totalRecords}, dests(&coin)...)
+		err := rows.Scan(append(dest, &coin.Snippet, &key)...)
 		if err != nil {
 			return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 		}
+		coin.Snippet = markSnippet(coin.Snippet)
 		coins = append(coins, &coin)
+		keys = append(keys, key)
 	}
 	if err = rows.Err(); err != nil {
 		return nil, Metadata{}, err // Update this to return an empty Metadata struct.
 	}
 	// Generate a Metadata struct, passing in the total record count and pagination
 	// parameters from the client.
-	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	more := len(coins) > filters.limit()
+	if more {
+		coins, keys = coins[:filters.limit()], keys[:filters.limit()]
+	}
+	if backwards {
+		slices.Reverse(coins)
+		slices.Reverse(keys)
+	}
+	var metadata Metadata
+	switch {
+	case cursorMode:
+		metadata = Metadata{PageSize: filters.PageSize}
+	case filters.SkipCount:
+		// Without the total, the last page isn't known, but the current page still is.
+		if len(coins) > 0 {
+			metadata = Metadata{CurrentPage: filters.Page, PageSize: filters.PageSize, FirstPage: 1}
+		}
+	default:
+		metadata = calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	}
+	// Work out which directions there are more rows in. Reading forwards, there are rows
+	// before this page if it was reached with a cursor or an offset, and the extra row
+	// tells us whether there are any after it. Reading backwards, it's the other way
+	// round.
+	if keyset && len(coins) > 0 {
+		hasNext, hasPrev := more, cursorMode || filters.offset() > 0
+		if backwards {
+			hasNext, hasPrev = true, more
+		}
+		first, last := 0, len(coins)-1
+		if hasNext {
+			metadata.NextCursor = encodeCursor(cursor{Sort: filters.Sort, Key: keys[last], ID: coins[last].ID})
+		}
+		if hasPrev {
+			metadata.PrevCursor = encodeCursor(cursor{Sort: filters.Sort, Key: keys[first], ID: coins[first].ID})
+		}
+	}
+	if len(filters.Facets) > 0 {
+		// The facet query only uses the filtering parameters, $1 to $16.
+		metadata.Facets, err = m.facets(from, args[:16], filters.Facets)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+	}
 	// Include the metadata struct when returning.
 	return coins, metadata, nil
 }
+
+// Stream calls fn with each coin matching the query, in the order of the filters' sort,
+// for exports which need every matching coin rather than a page of them. The pagination
+// and field settings in the filters are ignored.
+//
+// lib/pq reads the result rows off the connection as rows.Next() is called, so coins
+// are handed to fn as they arrive from the database and only one of them is held in
+// memory at a time. An export can take far longer than the usual query timeout, so the
+// query is bound to ctx instead, which is normally the request context; that way the
+// query is cancelled if the client goes away. If fn returns an error, streaming stops
+// and the error is returned.
+func (m CoinModel) Stream(ctx context.Context, q CoinQuery, filters Filters, fn func(coin *Coin) error) error {
+	from, rank := coinFilter(q)
+	sortColumn, sortDirection, _ := coinSort(filters, rank)
+	columns, dests := selectCoinColumns(nil)
+	query := fmt.Sprintf(`
+	SELECT %s
+	%s
+	ORDER BY %s %s, id %[4]s`, columns, from, sortColumn, sortDirection)
+	rows, err := m.DB.QueryContext(ctx, query, q.filterArgs()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var coin Coin
+		err := rows.Scan(dests(&coin)...)
+		if err != nil {
+			return err
+		}
+		err = fn(&coin)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Suggest returns up to limit distinct coin titles that complete or closely resemble
+// the search term, for search-as-you-type. Titles starting with the term come first,
+// followed by the closest fuzzy matches. Both conditions can use the trigram index on
+// title, and the short timeout keeps a slow query from holding up a typing user.
+func (m CoinModel) Suggest(term string, limit int) ([]string, error) {
+	query := `
+	SELECT title
+	FROM coins
+	WHERE title ILIKE $1 || '%' ESCAPE '\' OR $2 <% title
+	GROUP BY title
+	ORDER BY bool_or(title ILIKE $1 || '%' ESCAPE '\') DESC, max(word_similarity($2, title)) DESC, title ASC
+	LIMIT $3`
+	// Escape the LIKE wildcard characters in the term, so that they match literally.
+	prefix := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(term)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, prefix, term, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	titles := []string{}
+	for rows.Next() {
+		var title string
+		err := rows.Scan(&title)
+		if err != nil {
+			return nil, err
+		}
+		titles = append(titles, title)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return titles, nil
+}
@@ -0,0 +1,122 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The facets that can be counted on the coin list. The "metal" facet counts coins by
+// their composition.
+var FacetSafelist = []string{"genres", "year", "metal", "grade"}
+
+// FacetCount is the number of coins in the filtered set with a particular value, or
+// within a particular bucket for numeric fields. Value facets (genres and metal) set
+// Value, the year facet sets Min and Max to the first and last year of each century, and
+// the grade facet sets all three, with Value naming the band of Sheldon grades.
+type FacetCount struct {
+	Value string `json:"value,omitempty"`
+	Min   *int   `json:"min,omitempty"`
+	Max   *int   `json:"max,omitempty"`
+	Count int    `json:"count"`
+}
+
+// gradeBands splits the Sheldon scale into the bands used for the grade facet. The MS
+// band includes proof and specimen coins, which use the same numbers.
+var gradeBands = []struct {
+	label    string
+	min, max int
+}{
+	{"PO-AG", 1, 3},
+	{"G", 4, 7},
+	{"VG", 8, 11},
+	{"F", 12, 19},
+	{"VF", 20, 39},
+	{"EF", 40, 49},
+	{"AU", 50, 58},
+	{"MS", 60, 70},
+}
+
+// maxFacetValues limits the number of values returned for the genres and metal facets,
+// which could otherwise grow with every distinct value in the table.
+const maxFacetValues = 20
+
+// facetQueries holds the SQL which counts each facet over the "filtered" set of coins.
+// Every query returns the same columns: the facet name, value, bucket min, bucket max
+// and count.
+var facetQueries = map[string]string{
+	"genres": fmt.Sprintf(`
+	(SELECT 'genres', genre, NULL::integer, NULL::integer, count(*)
+	FROM filtered, unnest(genres) AS genre
+	GROUP BY genre
+	ORDER BY count(*) DESC, genre ASC
+	LIMIT %d)`, maxFacetValues),
+	"metal": fmt.Sprintf(`
+	(SELECT 'metal', composition, NULL::integer, NULL::integer, count(*)
+	FROM filtered
+	WHERE composition <> ''
+	GROUP BY composition
+	ORDER BY count(*) DESC, composition ASC
+	LIMIT %d)`, maxFacetValues),
+	"year": `
+	(SELECT 'year', '', century, century + 99, count(*)
+	FROM filtered
+	CROSS JOIN LATERAL (SELECT floor(year_start / 100.0)::integer * 100 AS century) AS bucket
+	GROUP BY century
+	ORDER BY century ASC)`,
+	"grade": fmt.Sprintf(`
+	(SELECT 'grade', band.label, band.min, band.max, count(*)
+	FROM filtered
+	INNER JOIN (VALUES %s) AS band (label, min, max)
+	ON grade_number BETWEEN band.min AND band.max
+	GROUP BY band.label, band.min, band.max
+	ORDER BY band.min ASC)`, gradeBandValues()),
+}
+
+func gradeBandValues() string {
+	values := make([]string, len(gradeBands))
+	for i, band := range gradeBands {
+		values[i] = fmt.Sprintf("('%s', %d, %d)", band.label, band.min, band.max)
+	}
+	return strings.Join(values, ", ")
+}
+
+// facets counts the requested facets over the coins matched by the FROM and WHERE
+// clauses in from, in a single query. Facets with no matching coins are returned as
+// empty slices rather than being left out.
+func (m CoinModel) facets(from string, args []interface{}, names []string) (map[string][]*FacetCount, error) {
+	facets := make(map[string][]*FacetCount, len(names))
+	parts := make([]string, len(names))
+	for i, name := range names {
+		q, ok := facetQueries[name]
+		if !ok {
+			panic("unsafe facet parameter: " + name)
+		}
+		parts[i] = q
+		facets[name] = []*FacetCount{}
+	}
+	query := fmt.Sprintf(`
+	WITH filtered AS (SELECT genres, composition, year_start, grade_number %s)
+	%s`, from, strings.Join(parts, "\n\tUNION ALL"))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var fc FacetCount
+		err := rows.Scan(&name, &fc.Value, &fc.Min, &fc.Max, &fc.Count)
+		if err != nil {
+			return nil, err
+		}
+		facets[name] = append(facets[name], &fc)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return facets, nil
+}
@@ -0,0 +1,92 @@
+package data
+
+import (
+	"strings"
+
+	"github.com/lib/pq"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// coinColumn links a field of the Coin JSON representation to the column that it's
+// stored in, and to the destination that the column is scanned into.
+type coinColumn struct {
+	field  string
+	column string
+	dest   func(coin *Coin) interface{}
+}
+
+// coinColumns lists the stored columns of the coins table in the order that they're
+// selected. Every field name is the same as the column name.
+var coinColumns = []coinColumn{
+	{"id", "id", func(c *Coin) interface{} { return &c.ID }},
+	{"created_at", "created_at", func(c *Coin) interface{} { return &c.CreatedAt }},
+	{"title", "title", func(c *Coin) interface{} { return &c.Title }},
+	{"year", "year", func(c *Coin) interface{} { return &c.Year }},
+	{"year_from", "year_from", func(c *Coin) interface{} { return &c.YearFrom }},
+	{"year_to", "year_to", func(c *Coin) interface{} { return &c.YearTo }},
+	{"era", "era", func(c *Coin) interface{} { return &c.Era }},
+	{"country", "country", func(c *Coin) interface{} { return &c.Country }},
+	{"denomination", "denomination", func(c *Coin) interface{} { return &c.Denomination }},
+	{"face_value", "face_value", func(c *Coin) interface{} { return &c.FaceValue }},
+	{"composition", "composition", func(c *Coin) interface{} { return &c.Composition }},
+	{"weight", "weight", func(c *Coin) interface{} { return &c.Weight }},
+	{"diameter", "diameter", func(c *Coin) interface{} { return &c.Diameter }},
+	{"mint", "mint", func(c *Coin) interface{} { return &c.Mint }},
+	{"mintage", "mintage", func(c *Coin) interface{} { return &c.Mintage }},
+	{"catalogue_refs", "catalogue_refs", func(c *Coin) interface{} { return pq.Array(&c.CatalogueRefs) }},
+	{"price", "price", func(c *Coin) interface{} { return &c.Price }},
+	{"price_source", "price_source", func(c *Coin) interface{} { return &c.PriceSource }},
+	{"grade", "grade", func(c *Coin) interface{} { return &c.Grade }},
+	{"grading_service", "grading_service", func(c *Coin) interface{} { return &c.GradingService }},
+	{"cert_number", "cert_number", func(c *Coin) interface{} { return &c.CertNumber }},
+	{"designations", "designations", func(c *Coin) interface{} { return pq.Array(&c.Designations) }},
+	{"legends", "legends", func(c *Coin) interface{} { return &c.Legends }},
+	{"description", "description", func(c *Coin) interface{} { return &c.Description }},
+	{"genres", "genres", func(c *Coin) interface{} { return pq.Array(&c.Genres) }},
+	{"version", "version", func(c *Coin) interface{} { return &c.Version }},
+}
+
+// CoinFields is the safelist of fields that clients can select with ?fields=. The
+// created_at column isn't part of the JSON representation, so it can't be selected.
+var CoinFields = []string{
+	"id", "title", "year", "year_from", "year_to", "era", "country", "denomination",
+	"face_value", "composition", "weight", "diameter", "mint", "mintage", "catalogue_refs",
+	"price", "price_source", "grade", "grading_service", "cert_number", "designations",
+	"legends", "description", "genres", "version",
+}
+
+// The related resources that can be embedded in a coin with ?include=.
+var CoinIncludes = []string{"images", "prices"}
+
+// ValidateFields checks that every requested field is in the safelist.
+func ValidateFields(v *validator.Validator, key string, fields, safelist []string) {
+	for _, field := range fields {
+		v.Check(validator.In(field, safelist...), key, "must only contain "+strings.Join(safelist, ", "))
+	}
+	v.Check(validator.Unique(fields), key, "must not contain duplicate values")
+}
+
+// selectCoinColumns returns the list of columns to select for the given fields, and a
+// function which returns the matching scan destinations for a coin. The id and version
+// columns are always selected, because they're needed to embed related resources,
+// build cursors and set ETag headers. An empty fields slice selects every column.
+func selectCoinColumns(fields []string) (string, func(coin *Coin) []interface{}) {
+	var selected []coinColumn
+	for _, col := range coinColumns {
+		if len(fields) == 0 || col.field == "id" || col.field == "version" || validator.In(col.field, fields...) {
+			selected = append(selected, col)
+		}
+	}
+	columns := make([]string, len(selected))
+	for i, col := range selected {
+		columns[i] = col.column
+	}
+	dests := func(coin *Coin) []interface{} {
+		d := make([]interface{}, len(selected))
+		for i, col := range selected {
+			d[i] = col.dest(coin)
+		}
+		return d
+	}
+	return strings.Join(columns, ", "), dests
+}
@@ -1,7 +1,10 @@
 package data
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"math"
+	"regexp"
 	"strings" // New import
 
 	"greenlight.alexedwards.net/internal/validator"
@@ -12,6 +15,90 @@ type Filters struct {
 	PageSize     int
 	Sort         string
 	SortSafelist []string
+	Facets       []string
+	// Fields limits the fields read and returned for each record to a sparse fieldset,
+	// checked against FieldSafelist. It's empty to return every field.
+	Fields        []string
+	FieldSafelist []string
+	// After and Before hold the cursors for keyset pagination. At most one of them
+	// can be set, and when one is Page is ignored.
+	After  string
+	Before string
+	// SkipCount turns off counting the total number of matching records, which means
+	// reading every one of them, for clients that don't need the last page or total.
+	SkipCount bool
+}
+
+// cursor is the decoded form of a keyset pagination cursor. It records the value of
+// the sort column and the id of the row that it points to, along with the sort that it
+// was created for, so that it can't be used to page through a different ordering.
+// Key holds the sort column value in PostgreSQL's text format, which can be passed
+// back in as a query parameter for any column type without losing precision.
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int64  `json:"i"`
+}
+
+func encodeCursor(c cursor) string {
+	js, err := json.Marshal(c)
+	if err != nil {
+		// Marshalling a struct of strings and integers can't fail.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(js)
+}
+
+func decodeCursor(s string) (cursor, error) {
+	var c cursor
+	js, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	err = json.Unmarshal(js, &c)
+	return c, err
+}
+
+// cursorKeyPatterns holds the format of the cursor key for each sort column which isn't
+// text, so that a cursor that's been tampered with is rejected, rather than reaching the
+// database as a value that can't be cast to the column's type.
+var cursorKeyPatterns = map[string]*regexp.Regexp{
+	"id":         regexp.MustCompile(`^[0-9]{1,18}$`),
+	"year":       regexp.MustCompile(`^-?[0-9]{1,9}$`),
+	"mintage":    regexp.MustCompile(`^[0-9]{1,18}$`),
+	"grade":      regexp.MustCompile(`^[0-9]{1,4}$`),
+	"face_value": regexp.MustCompile(`^[0-9]{1,10}(\.[0-9]+)?$`),
+}
+
+// validCursorKey reports whether a cursor's key could have come from its sort column.
+// Text keys can hold anything except a NUL character, which PostgreSQL doesn't allow.
+func validCursorKey(c cursor) bool {
+	if c.ID <= 0 || strings.ContainsRune(c.Key, 0) {
+		return false
+	}
+	pattern, ok := cursorKeyPatterns[strings.TrimPrefix(c.Sort, "-")]
+	return !ok || pattern.MatchString(c.Key)
+}
+
+// cursor returns the decoded After or Before cursor, and whether it's a Before cursor
+// (so that the page has to be read backwards). The ok result is false when the filters
+// don't use keyset pagination.
+func (f Filters) cursor() (c cursor, backwards bool, ok bool) {
+	switch {
+	case f.After != "":
+		c, err := decodeCursor(f.After)
+		if err != nil {
+			panic("unvalidated cursor: " + f.After)
+		}
+		return c, false, true
+	case f.Before != "":
+		c, err := decodeCursor(f.Before)
+		if err != nil {
+			panic("unvalidated cursor: " + f.Before)
+		}
+		return c, true, true
+	}
+	return cursor{}, false, false
 }
 
 // Check that the client-provided Sort field matches one of the entries in our safelist
@@ -43,6 +130,23 @@ func ValidateFilters(v *validator.Validator, f Filters) {
 	v.Check(f.PageSize <= 100, "page_size", "must be a maximum of 100")
 	// Check that the sort parameter matches a value in the safelist.
 	v.Check(validator.In(f.Sort, f.SortSafelist...), "sort", "invalid sort value")
+	// Check that every requested facet is one that we know how to count.
+	for _, facet := range f.Facets {
+		v.Check(validator.In(facet, FacetSafelist...), "facets", "must only contain genres, year, metal or grade")
+	}
+	v.Check(validator.Unique(f.Facets), "facets", "must not contain duplicate values")
+	ValidateFields(v, "fields", f.Fields, f.FieldSafelist)
+	// Check that a cursor was issued by us for the same sort order.
+	for key, value := range map[string]string{"after": f.After, "before": f.Before} {
+		if value != "" {
+			c, err := decodeCursor(value)
+			v.Check(err == nil && c.Sort == f.Sort && validCursorKey(c), key, "invalid or expired cursor")
+		}
+	}
+	v.Check(f.After == "" || f.Before == "", "before", "must not be used with after")
+	if f.After != "" || f.Before != "" {
+		v.Check(f.Page == 1, "page", "must not be used with after or before")
+	}
 }
 
 func (f Filters) limit() int {
@@ -58,6 +162,12 @@ type Metadata struct {
 	FirstPage    int `json:"first_page,omitempty"`
 	LastPage     int `json:"last_page,omitempty"`
 	TotalRecords int `json:"total_records,omitempty"`
+	// NextCursor and PrevCursor are passed back as the after and before parameters to
+	// fetch the next and previous pages with keyset pagination.
+	NextCursor string `json:"next_cursor,omitempty"`
+	PrevCursor string `json:"prev_cursor,omitempty"`
+	// Facets holds the facet counts requested with Filters.Facets, keyed by facet name.
+	Facets map[string][]*FacetCount `json:"facets,omitempty"`
 }
 
 // The calculateMetadata() function calculates the appropriate pagination metadata
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+var (
+	ErrDuplicateCertificate = errors.New("duplicate certificate")
+	ErrInvalidGradeFormat   = errors.New("invalid grade format")
+)
+
+// GradeRX matches a grade in the format "<adjectival>-<number>", like "MS-65".
+var GradeRX = regexp.MustCompile(`^([A-Z]{1,2})-(\d{1,2})$`)
+
+// gradeRanges maps each adjectival grade to the range of Sheldon numbers that it
+// covers. Proof (PR/PF) and specimen (SP) strikes use the same numbers as mint state.
+var gradeRanges = map[string][2]int{
+	"PO": {1, 1},
+	"FR": {2, 2},
+	"AG": {3, 3},
+	"G":  {4, 6},
+	"VG": {8, 10},
+	"F":  {12, 15},
+	"VF": {20, 35},
+	"EF": {40, 45},
+	"XF": {40, 45},
+	"AU": {50, 58},
+	"MS": {60, 70},
+	"PR": {60, 70},
+	"PF": {60, 70},
+	"SP": {60, 70},
+}
+
+// The third-party grading services whose certificates we record.
+var GradingServices = []string{"PCGS", "NGC", "ANACS", "ICG", "CGC"}
+
+// Strike designations. RD, RB and BN describe the colour of copper coins, and PL and
+// DMPL describe prooflike surfaces.
+var (
+	ColourDesignations    = []string{"RD", "RB", "BN"}
+	ProoflikeDesignations = []string{"PL", "DMPL"}
+)
+
+// ParseGrade splits a grade like "MS-65" into its adjectival and numeric parts,
+// checking that the number is on the Sheldon scale and matches the adjectival grade.
+func ParseGrade(grade string) (string, int, error) {
+	matches := GradeRX.FindStringSubmatch(grade)
+	if matches == nil {
+		return "", 0, ErrInvalidGradeFormat
+	}
+	number, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return "", 0, ErrInvalidGradeFormat
+	}
+	r, ok := gradeRanges[matches[1]]
+	if !ok || number < r[0] || number > r[1] {
+		return "", 0, ErrInvalidGradeFormat
+	}
+	return matches[1], number, nil
+}
+
+// ValidateGrading checks the grade, certification and designation fields of a coin.
+// An empty grade means that the coin is ungraded.
+func ValidateGrading(v *validator.Validator, coin *Coin) {
+	if coin.Grade != "" {
+		_, _, err := ParseGrade(coin.Grade)
+		v.Check(err == nil, "grade", "must be a valid Sheldon grade such as MS-65")
+	}
+	if coin.GradingService != "" || coin.CertNumber != "" {
+		v.Check(coin.Grade != "", "grade", "must be provided for a certified coin")
+		v.Check(validator.In(coin.GradingService, GradingServices...), "grading_service", "must be one of PCGS, NGC, ANACS, ICG or CGC")
+		v.Check(coin.CertNumber != "", "cert_number", "must be provided with grading_service")
+		v.Check(len(coin.CertNumber) <= 50, "cert_number", "must not be more than 50 bytes long")
+	}
+
+	colours, prooflikes := 0, 0
+	for _, d := range coin.Designations {
+		switch {
+		case validator.In(d, ColourDesignations...):
+			colours++
+		case validator.In(d, ProoflikeDesignations...):
+			prooflikes++
+		default:
+			v.AddError("designations", "must only contain PL, DMPL, RD, RB or BN")
+		}
+	}
+	v.Check(colours <= 1, "designations", "must not contain more than one of RD, RB or BN")
+	v.Check(prooflikes <= 1, "designations", "must not contain both PL and DMPL")
+	v.Check(len(coin.Designations) == 0 || coin.Grade != "", "designations", "must only be provided for a graded coin")
+}
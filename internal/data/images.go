@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The sides of a coin (or its holder) that an image can show.
+var ImageSides = []string{"obverse", "reverse", "edge", "slab"}
+
+// The image formats that we accept for upload, all of which can be decoded by the
+// standard library to generate thumbnails.
+var ImageContentTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// CoinImage holds the details of an uploaded coin photo. The files themselves live in
+// blob storage under Key and ThumbnailKey; the URL fields are filled in by the API from
+// those keys when the image is sent to a client.
+type CoinImage struct {
+	ID           int64     `json:"id"`
+	CoinID       int64     `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	Side         string    `json:"side"`
+	ContentType  string    `json:"content_type"`
+	Size         int64     `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Key          string    `json:"-"`
+	ThumbnailKey string    `json:"-"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+}
+
+func ValidateCoinImage(v *validator.Validator, image *CoinImage) {
+	v.Check(validator.In(image.Side, ImageSides...), "side", "must be one of obverse, reverse, edge or slab")
+	v.Check(validator.In(image.ContentType, ImageContentTypes...), "image", "must be a JPEG, PNG or GIF image")
+	v.Check(image.Width > 0 && image.Height > 0, "image", "must have a non-zero width and height")
+}
+
+type CoinImageModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a new image record. A coin's images are part of its representation, so
+// the coin's version is bumped at the same time, which changes its ETag.
+func (m CoinImageModel) Insert(image *CoinImage) error {
+	query := `
+	WITH image AS (
+		INSERT INTO coin_images (coin_id, side, content_type, size, width, height, key, thumbnail_key)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at
+	), coin AS (
+		UPDATE coins SET version = version + 1
+		WHERE id = $1
+	)
+	SELECT id, created_at FROM image`
+	args := []interface{}{
+		image.CoinID,
+		image.Side,
+		image.ContentType,
+		image.Size,
+		image.Width,
+		image.Height,
+		image.Key,
+		image.ThumbnailKey,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&image.ID, &image.CreatedAt)
+}
+
+func (m CoinImageModel) Get(coinID, id int64) (*CoinImage, error) {
+	query := `
+	SELECT id, coin_id, created_at, side, content_type, size, width, height, key, thumbnail_key
+	FROM coin_images
+	WHERE coin_id = $1 AND id = $2`
+	var image CoinImage
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, coinID, id).Scan(
+		&image.ID,
+		&image.CoinID,
+		&image.CreatedAt,
+		&image.Side,
+		&image.ContentType,
+		&image.Size,
+		&image.Width,
+		&image.Height,
+		&image.Key,
+		&image.ThumbnailKey,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &image, nil
+}
+
+// GetAllForCoins returns the images for a set of coins in a single query, keyed by coin
+// ID, so that a page of coins can be sent with their images without a query per coin.
+func (m CoinImageModel) GetAllForCoins(coinIDs ...int64) (map[int64][]*CoinImage, error) {
+	query := `
+	SELECT id, coin_id, created_at, side, content_type, size, width, height, key, thumbnail_key
+	FROM coin_images
+	WHERE coin_id = ANY($1)
+	ORDER BY coin_id, array_position('{obverse,reverse,edge,slab}', side), id`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(coinIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	images := make(map[int64][]*CoinImage)
+	for rows.Next() {
+		var image CoinImage
+		err := rows.Scan(
+			&image.ID,
+			&image.CoinID,
+			&image.CreatedAt,
+			&image.Side,
+			&image.ContentType,
+			&image.Size,
+			&image.Width,
+			&image.Height,
+			&image.Key,
+			&image.ThumbnailKey,
+		)
+		if err != nil {
+			return nil, err
+		}
+		images[image.CoinID] = append(images[image.CoinID], &image)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return images, nil
+}
+
+// Delete removes an image record, bumping the coin's version like Insert does.
+func (m CoinImageModel) Delete(coinID, id int64) error {
+	query := `
+	WITH image AS (
+		DELETE FROM coin_images
+		WHERE coin_id = $1 AND id = $2
+		RETURNING coin_id
+	), coin AS (
+		UPDATE coins SET version = version + 1
+		WHERE id IN (SELECT coin_id FROM image)
+	)
+	SELECT count(*) FROM image`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	var deleted int
+	err := m.DB.QueryRowContext(ctx, query, coinID, id).Scan(&deleted)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -12,7 +12,10 @@ var (
 
 type Models struct {
 	Coins       CoinModel
+	Images      CoinImageModel
 	Permissions PermissionModel // Add a new Permissions field.
+	Prices      CoinPriceModel
+	Rates       RateModel
 	Tokens      TokenModel
 	Users       UserModel
 }
@@ -20,7 +23,10 @@ type Models struct {
 func NewModels(db *sql.DB) Models {
 	return Models{
 		Coins:       CoinModel{DB: db},
+		Images:      CoinImageModel{DB: db},
 		Permissions: PermissionModel{DB: db}, // Initialize a new PermissionModel instance.
+		Prices:      CoinPriceModel{DB: db},
+		Rates:       RateModel{DB: db},
 		Tokens:      TokenModel{DB: db},
 		Users:       UserModel{DB: db},
 	}
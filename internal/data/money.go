@@ -0,0 +1,159 @@
+package data
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// Define an error that our UnmarshalJSON() and ParseMoney() functions can return if we're
+// unable to parse or convert a money value successfully.
+var ErrInvalidMoneyFormat = errors.New("invalid money format")
+
+// CurrencyRX matches a three-letter ISO 4217 currency code.
+var CurrencyRX = regexp.MustCompile("^[A-Z]{3}$")
+
+// currencyExponents maps the ISO 4217 currencies that we accept to the number of digits
+// after the decimal point in their minor unit (for example, 2 for USD cents and 0 for JPY).
+var currencyExponents = map[string]int{
+	"AED": 2, "AUD": 2, "BHD": 3, "BRL": 2, "CAD": 2, "CHF": 2, "CLP": 0, "CNY": 2,
+	"CZK": 2, "DKK": 2, "EUR": 2, "GBP": 2, "HKD": 2, "HUF": 2, "ILS": 2, "INR": 2,
+	"ISK": 0, "JOD": 3, "JPY": 0, "KRW": 0, "KWD": 3, "KZT": 2, "MXN": 2, "NOK": 2,
+	"NZD": 2, "OMR": 3, "PLN": 2, "RUB": 2, "SAR": 2, "SEK": 2, "SGD": 2, "TND": 3,
+	"TRY": 2, "USD": 2, "VND": 0, "ZAR": 2,
+}
+
+// Money represents an amount of money in a specific currency. The amount is held as an
+// integer number of minor units (cents, pence, etc.) so that we never have to trust
+// floating-point arithmetic with prices.
+type Money struct {
+	Amount   int64
+	Currency string
+}
+
+// KnownCurrency returns true if the currency code is one that we accept.
+func KnownCurrency(code string) bool {
+	_, ok := currencyExponents[code]
+	return ok
+}
+
+// String returns the money value in the format "<amount> <currency>", for example
+// "1250.00 USD", with the number of decimal places set by the currency.
+func (m Money) String() string {
+	exp := currencyExponents[m.Currency]
+	if exp == 0 {
+		return fmt.Sprintf("%d %s", m.Amount, m.Currency)
+	}
+	sign := ""
+	amount := m.Amount
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	unit := int64(math.Pow10(exp))
+	return fmt.Sprintf("%s%d.%0*d %s", sign, amount/unit, exp, amount%unit, m.Currency)
+}
+
+// ParseMoney parses a string in the format "<amount> <currency>", as generated by
+// String(). The amount must not have more decimal places than the currency allows.
+func ParseMoney(s string) (Money, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 2 || !KnownCurrency(parts[1]) {
+		return Money{}, ErrInvalidMoneyFormat
+	}
+	amount, err := parseMinorUnits(parts[0], currencyExponents[parts[1]])
+	if err != nil {
+		return Money{}, ErrInvalidMoneyFormat
+	}
+	return Money{Amount: amount, Currency: parts[1]}, nil
+}
+
+// parseMinorUnits converts a decimal string like "12.5" into an integer number of minor
+// units, given the currency exponent. It works on the string digits directly, so no
+// precision is lost to floating-point rounding.
+func parseMinorUnits(s string, exp int) (int64, error) {
+	whole, frac, found := strings.Cut(s, ".")
+	if found && (frac == "" || len(frac) > exp) {
+		return 0, ErrInvalidMoneyFormat
+	}
+	frac += strings.Repeat("0", exp-len(frac))
+	if strings.HasPrefix(frac, "-") || strings.HasPrefix(frac, "+") {
+		return 0, ErrInvalidMoneyFormat
+	}
+	i, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidMoneyFormat
+	}
+	return i, nil
+}
+
+// Implement a MarshalJSON() method on the Money type so that it satisfies the
+// json.Marshaler interface. Like Runtime, it's encoded as a JSON string, in the format
+// "<amount> <currency>".
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(m.String())), nil
+}
+
+// Implement an UnmarshalJSON() method on the Money type so that it satisfies the
+// json.Unmarshaler interface. IMPORTANT: Because UnmarshalJSON() needs to modify the
+// receiver (our Money type), we must use a pointer receiver for this to work correctly.
+func (m *Money) UnmarshalJSON(jsonValue []byte) error {
+	// We expect that the incoming JSON value will be a string in the format
+	// "<amount> <currency>", and the first thing we need to do is remove the surrounding
+	// double-quotes from this string.
+	unquotedJSONValue, err := strconv.Unquote(string(jsonValue))
+	if err != nil {
+		return ErrInvalidMoneyFormat
+	}
+	money, err := ParseMoney(unquotedJSONValue)
+	if err != nil {
+		return err
+	}
+	*m = money
+	return nil
+}
+
+// Value implements the driver.Valuer interface. Money is stored in PostgreSQL using the
+// money_amount composite type, which has the text representation "(<amount>,<currency>)".
+func (m Money) Value() (driver.Value, error) {
+	if !validator.Matches(m.Currency, CurrencyRX) {
+		return nil, fmt.Errorf("invalid currency code %q", m.Currency)
+	}
+	return fmt.Sprintf("(%d,%s)", m.Amount, m.Currency), nil
+}
+
+// Scan implements the sql.Scanner interface, reading a money_amount composite value.
+func (m *Money) Scan(src interface{}) error {
+	var s string
+	switch src := src.(type) {
+	case []byte:
+		s = string(src)
+	case string:
+		s = src
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+	amount, currency, found := strings.Cut(strings.Trim(s, "()"), ",")
+	if !found {
+		return fmt.Errorf("cannot scan %q into Money", s)
+	}
+	i, err := strconv.ParseInt(amount, 10, 64)
+	if err != nil {
+		return err
+	}
+	m.Amount = i
+	m.Currency = strings.TrimSpace(currency)
+	return nil
+}
+
+func ValidateMoney(v *validator.Validator, key string, m Money) {
+	v.Check(KnownCurrency(m.Currency), key, "must use a supported ISO 4217 currency code")
+	v.Check(m.Amount >= 0, key, "must not be negative")
+	v.Check(m.Amount <= 1_000_000_000_000, key, "must not be more than 1 trillion minor units")
+}
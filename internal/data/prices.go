@@ -0,0 +1,184 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+// The sources that a coin price can come from.
+const (
+	PriceSourceDealerQuote   = "dealer_quote"
+	PriceSourceAuctionResult = "auction_result"
+	PriceSourceManual        = "manual"
+)
+
+var PriceSources = []string{PriceSourceDealerQuote, PriceSourceAuctionResult, PriceSourceManual}
+
+// CoinPrice is a single entry in a coin's price history.
+type CoinPrice struct {
+	ID         int64     `json:"id"`
+	CoinID     int64     `json:"coin_id"`
+	Price      Money     `json:"price"`
+	Source     string    `json:"source"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// PriceAggregate summarises the price history entries for a coin within one period
+// (a day or a month) and one currency.
+type PriceAggregate struct {
+	Period  time.Time `json:"period"`
+	Count   int       `json:"count"`
+	Min     Money     `json:"min"`
+	Max     Money     `json:"max"`
+	Average Money     `json:"average"`
+	Last    Money     `json:"last"`
+}
+
+// PriceHistoryQuery holds the criteria for retrieving a coin's price history. From and
+// To are inclusive dates, and a zero value leaves that end of the range open. Interval
+// is "day" or "month" to aggregate the history, or empty to return every entry.
+type PriceHistoryQuery struct {
+	From     time.Time
+	To       time.Time
+	Interval string
+}
+
+var PriceIntervals = []string{"day", "month"}
+
+func ValidatePriceHistoryQuery(v *validator.Validator, q PriceHistoryQuery) {
+	if !q.From.IsZero() && !q.To.IsZero() {
+		v.Check(!q.To.Before(q.From), "to", "must not be before from")
+	}
+	if q.Interval != "" {
+		v.Check(validator.In(q.Interval, PriceIntervals...), "interval", "must be day or month")
+	}
+}
+
+// dateRange returns the query's date range as arguments for a half-open range
+// [from, to), filling in the open ends and moving To forward a day so that it's
+// inclusive.
+func (q PriceHistoryQuery) dateRange() (time.Time, time.Time) {
+	from, to := q.From, q.To
+	if to.IsZero() {
+		to = time.Now()
+	}
+	return from, to.AddDate(0, 0, 1)
+}
+
+type CoinPriceModel struct {
+	DB *sql.DB
+}
+
+// GetAllForCoin returns every price history entry for a coin within the date range,
+// oldest first.
+func (m CoinPriceModel) GetAllForCoin(coinID int64, q PriceHistoryQuery) ([]*CoinPrice, error) {
+	query := `
+	SELECT id, coin_id, price, source, recorded_at
+	FROM coin_prices
+	WHERE coin_id = $1
+	AND recorded_at >= $2 AND recorded_at < $3
+	ORDER BY recorded_at ASC, id ASC`
+	from, to := q.dateRange()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, coinID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := []*CoinPrice{}
+	for rows.Next() {
+		var price CoinPrice
+		err := rows.Scan(&price.ID, &price.CoinID, &price.Price, &price.Source, &price.RecordedAt)
+		if err != nil {
+			return nil, err
+		}
+		prices = append(prices, &price)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+// GetAllForCoins returns the full price history of a set of coins in a single query,
+// keyed by coin ID and oldest first, for embedding in coin responses.
+func (m CoinPriceModel) GetAllForCoins(coinIDs ...int64) (map[int64][]*CoinPrice, error) {
+	query := `
+	SELECT id, coin_id, price, source, recorded_at
+	FROM coin_prices
+	WHERE coin_id = ANY($1)
+	ORDER BY coin_id, recorded_at ASC, id ASC`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, pq.Array(coinIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	prices := make(map[int64][]*CoinPrice)
+	for rows.Next() {
+		var price CoinPrice
+		err := rows.Scan(&price.ID, &price.CoinID, &price.Price, &price.Source, &price.RecordedAt)
+		if err != nil {
+			return nil, err
+		}
+		prices[price.CoinID] = append(prices[price.CoinID], &price)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return prices, nil
+}
+
+// Aggregate returns a coin's price history within the date range grouped into daily
+// or monthly periods. Prices in different currencies are never mixed, so a period with
+// prices in two currencies returns one aggregate for each.
+func (m CoinPriceModel) Aggregate(coinID int64, q PriceHistoryQuery) ([]*PriceAggregate, error) {
+	// The interval has already been checked against the PriceIntervals safelist, and
+	// date_trunc() needs it as a string literal rather than a placeholder value for the
+	// GROUP BY clause to match.
+	if !validator.In(q.Interval, PriceIntervals...) {
+		panic("unsafe price interval: " + q.Interval)
+	}
+	query := fmt.Sprintf(`
+	SELECT date_trunc('%[1]s', recorded_at) AS period, (price).currency, count(*),
+		min((price).amount), max((price).amount), round(avg((price).amount))::bigint,
+		(array_agg((price).amount ORDER BY recorded_at DESC, id DESC))[1]
+	FROM coin_prices
+	WHERE coin_id = $1
+	AND recorded_at >= $2 AND recorded_at < $3
+	GROUP BY date_trunc('%[1]s', recorded_at), (price).currency
+	ORDER BY period ASC, (price).currency ASC`, q.Interval)
+	from, to := q.dateRange()
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, coinID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aggregates := []*PriceAggregate{}
+	for rows.Next() {
+		var a PriceAggregate
+		var currency string
+		err := rows.Scan(&a.Period, &currency, &a.Count, &a.Min.Amount, &a.Max.Amount, &a.Average.Amount, &a.Last.Amount)
+		if err != nil {
+			return nil, err
+		}
+		a.Min.Currency = currency
+		a.Max.Currency = currency
+		a.Average.Currency = currency
+		a.Last.Currency = currency
+		aggregates = append(aggregates, &a)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return aggregates, nil
+}
@@ -0,0 +1,220 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+
+	"greenlight.alexedwards.net/internal/validator"
+)
+
+var (
+	ErrInvalidRateFile = errors.New("invalid exchange rate file")
+	ErrUnknownRate     = errors.New("no exchange rate for currency")
+)
+
+// RateSnapshot is a set of exchange rates loaded at a single point in time. Each rate
+// is the number of units of a currency that one unit of the Base currency buys, so the
+// rate for the base currency itself is always 1.
+type RateSnapshot struct {
+	ID        int64               `json:"id"`
+	CreatedAt time.Time           `json:"created_at"`
+	Source    string              `json:"source"`
+	Base      string              `json:"base"`
+	Rates     map[string]*big.Rat `json:"-"`
+}
+
+// RateStrings returns the snapshot's rates as decimal strings, suitable for including
+// in a JSON response without losing precision.
+func (s *RateSnapshot) RateStrings() map[string]string {
+	rates := make(map[string]string, len(s.Rates))
+	for currency, rate := range s.Rates {
+		rates[currency] = rate.FloatString(6)
+	}
+	return rates
+}
+
+// Convert converts a money value into the target currency using the snapshot's rates.
+// The result is rounded half away from zero to the target currency's minor unit.
+func (s *RateSnapshot) Convert(m Money, currency string) (Money, error) {
+	if m.Currency == currency {
+		return m, nil
+	}
+	fromRate, ok := s.rate(m.Currency)
+	if !ok {
+		return Money{}, ErrUnknownRate
+	}
+	toRate, ok := s.rate(currency)
+	if !ok {
+		return Money{}, ErrUnknownRate
+	}
+	// Work out the amount in the target currency's minor units:
+	// amount / 10^fromExp / fromRate * toRate * 10^toExp.
+	amount := new(big.Rat).SetInt64(m.Amount)
+	amount.Mul(amount, toRate)
+	amount.Quo(amount, fromRate)
+	amount.Mul(amount, pow10Rat(currencyExponents[currency]))
+	amount.Quo(amount, pow10Rat(currencyExponents[m.Currency]))
+	return Money{Amount: roundRat(amount), Currency: currency}, nil
+}
+
+func (s *RateSnapshot) rate(currency string) (*big.Rat, bool) {
+	if currency == s.Base {
+		return big.NewRat(1, 1), true
+	}
+	rate, ok := s.Rates[currency]
+	return rate, ok
+}
+
+func pow10Rat(exp int) *big.Rat {
+	return new(big.Rat).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil))
+}
+
+// roundRat rounds a rational number half away from zero to the nearest int64.
+func roundRat(r *big.Rat) int64 {
+	num := new(big.Int).Abs(r.Num())
+	q, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Mul(rem, big.NewInt(2)).Cmp(r.Denom()) >= 0 {
+		q.Add(q, big.NewInt(1))
+	}
+	if r.Sign() < 0 {
+		q.Neg(q)
+	}
+	return q.Int64()
+}
+
+// ParseRatesCSV reads a rate file in CSV format. The file must have a header row of
+// "currency,rate", followed by one row per currency.
+func ParseRatesCSV(r io.Reader) (map[string]*big.Rat, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+	}
+	if len(records) < 1 || len(records[0]) != 2 || strings.TrimSpace(records[0][0]) != "currency" || strings.TrimSpace(records[0][1]) != "rate" {
+		return nil, fmt.Errorf(`%w: header row must be "currency,rate"`, ErrInvalidRateFile)
+	}
+	rates := make(map[string]*big.Rat, len(records)-1)
+	for i, record := range records[1:] {
+		rate, ok := new(big.Rat).SetString(strings.TrimSpace(record[1]))
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid rate on line %d", ErrInvalidRateFile, i+2)
+		}
+		rates[strings.TrimSpace(record[0])] = rate
+	}
+	return rates, nil
+}
+
+// ParseRatesJSON reads a rate file in JSON format, which is an object mapping currency
+// codes to decimal rates. The rates must be JSON strings, so that they aren't decoded
+// as floating-point numbers.
+func ParseRatesJSON(r io.Reader) (map[string]*big.Rat, error) {
+	var input map[string]string
+	err := json.NewDecoder(r).Decode(&input)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidRateFile, err)
+	}
+	rates := make(map[string]*big.Rat, len(input))
+	for currency, s := range input {
+		rate, ok := new(big.Rat).SetString(s)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid rate for %s", ErrInvalidRateFile, currency)
+		}
+		rates[currency] = rate
+	}
+	return rates, nil
+}
+
+func ValidateRateSnapshot(v *validator.Validator, s *RateSnapshot) {
+	v.Check(KnownCurrency(s.Base), "base", "must use a supported ISO 4217 currency code")
+	v.Check(len(s.Source) <= 500, "source", "must not be more than 500 bytes long")
+	v.Check(len(s.Rates) >= 1, "rates", "must contain at least 1 rate")
+	for currency, rate := range s.Rates {
+		v.Check(KnownCurrency(currency), "rates", fmt.Sprintf("contains unsupported currency code %q", currency))
+		v.Check(rate.Sign() > 0, "rates", fmt.Sprintf("must be greater than zero for %s", currency))
+	}
+}
+
+type RateModel struct {
+	DB *sql.DB
+}
+
+// Insert adds a new snapshot and all of its rates in a single transaction.
+func (m RateModel) Insert(snapshot *RateSnapshot) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO rate_snapshots (source, base)
+	VALUES ($1, $2)
+	RETURNING id, created_at`
+	err = tx.QueryRowContext(ctx, query, snapshot.Source, snapshot.Base).Scan(&snapshot.ID, &snapshot.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	query = `
+	INSERT INTO rates (snapshot_id, currency, rate)
+	VALUES ($1, $2, $3)`
+	for currency, rate := range snapshot.Rates {
+		_, err = tx.ExecContext(ctx, query, snapshot.ID, currency, rate.FloatString(10))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Latest returns the most recently loaded snapshot, or ErrRecordNotFound if no rates
+// have been loaded yet.
+func (m RateModel) Latest() (*RateSnapshot, error) {
+	query := `
+	SELECT rate_snapshots.id, rate_snapshots.created_at, rate_snapshots.source,
+		rate_snapshots.base, rates.currency, rates.rate
+	FROM rate_snapshots
+	INNER JOIN rates ON rates.snapshot_id = rate_snapshots.id
+	WHERE rate_snapshots.id = (SELECT max(id) FROM rate_snapshots)`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var snapshot *RateSnapshot
+	for rows.Next() {
+		var s RateSnapshot
+		var currency, rate string
+		err := rows.Scan(&s.ID, &s.CreatedAt, &s.Source, &s.Base, &currency, &rate)
+		if err != nil {
+			return nil, err
+		}
+		if snapshot == nil {
+			snapshot = &s
+			snapshot.Rates = make(map[string]*big.Rat)
+		}
+		r, ok := new(big.Rat).SetString(rate)
+		if !ok {
+			return nil, fmt.Errorf("invalid stored rate %q for %s", rate, currency)
+		}
+		snapshot.Rates[currency] = r
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return nil, ErrRecordNotFound
+	}
+	return snapshot, nil
+}
@@ -7,23 +7,52 @@ import (
 	"crypto/sha256"
 	"database/sql" // New import
 	"encoding/base32"
+	"errors"
 	"time"
 
+	"github.com/lib/pq"
 	"greenlight.alexedwards.net/internal/validator" // New import
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication" // Include a new authentication scope.
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
 )
 
+// ErrTokenReused is returned when a refresh token that has already been exchanged is
+// presented again.
+var ErrTokenReused = errors.New("refresh token reused")
+
 // Add struct tags to control how the struct appears when encoded to JSON.
+//
+// Every token belongs to a family. The access and refresh tokens issued at login start a
+// new family, and the tokens which replace them when the refresh token is rotated join
+// it, so a family is one login session.
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
+	ID        int64     `json:"-"`
 	UserID    int64     `json:"-"`
+	FamilyID  int64     `json:"-"` // Zero to start a new family.
+	CreatedAt time.Time `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	UserAgent string    `json:"-"`
+	IP        string    `json:"-"`
+}
+
+// Session describes a family of authentication and refresh tokens, so that users can
+// see where they're logged in. Its ID is the family ID.
+type Session struct {
+	ID         int64      `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	Current    bool       `json:"current,omitempty"` // Not stored; set for the caller's session.
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -83,15 +112,132 @@ func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token,
 	err = m.Insert(token)
 	return token, err
 }
+
 func (m TokenModel) Insert(token *Token) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	return insertToken(ctx, m.DB, token)
+}
+
+// insertToken inserts the token, starting a new family for it unless it already has a
+// FamilyID.
+func insertToken(ctx context.Context, db dbtx, token *Token) error {
 	query := `
-	INSERT INTO tokens (hash, user_id, expiry, scope)
-	VALUES ($1, $2, $3, $4)`
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	INSERT INTO tokens (hash, user_id, expiry, scope, user_agent, ip, family_id)
+	VALUES ($1, $2, $3, $4, $5, $6, COALESCE(NULLIF($7::bigint, 0), nextval('tokens_family_id_seq')))
+	RETURNING id, created_at, family_id`
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.UserAgent, token.IP, token.FamilyID}
+	return db.QueryRowContext(ctx, query, args...).Scan(&token.ID, &token.CreatedAt, &token.FamilyID)
+}
+
+// NewSession logs a user in, creating a short-lived authentication (access) token and a
+// long-lived refresh token in a new family. When access tokens are signed rather than
+// stored, accessTTL is zero and only the refresh token is created, with a nil access
+// token returned.
+func (m TokenModel) NewSession(userID int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (access, refresh *Token, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
-	_, err := m.DB.ExecContext(ctx, query, args...)
-	return err
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+	access, refresh, err = issueSession(ctx, tx, userID, 0, accessTTL, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, tx.Commit()
+}
+
+// issueSession creates a refresh token and, unless accessTTL is zero, an authentication
+// token in the family.
+func issueSession(ctx context.Context, db dbtx, userID, familyID int64, accessTTL, refreshTTL time.Duration, userAgent, ip string) (*Token, *Token, error) {
+	refresh, err := generateToken(userID, refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	refresh.FamilyID = familyID
+	refresh.UserAgent, refresh.IP = userAgent, ip
+	err = insertToken(ctx, db, refresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	if accessTTL == 0 {
+		return nil, refresh, nil
+	}
+	access, err := generateToken(userID, accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The authentication token joins the refresh token's family, which is new if
+	// familyID was zero.
+	access.FamilyID = refresh.FamilyID
+	access.UserAgent, access.IP = userAgent, ip
+	err = insertToken(ctx, db, access)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, nil
+}
+
+// Rotate exchanges a refresh token for a new authentication token (unless accessTTL is
+// zero, as for NewSession) and a new refresh token in the same family. Each refresh
+// token can only be exchanged once. If one is presented again, it has probably been
+// stolen, and there's no way to tell whether the thief or the user is presenting it,
+// so the whole family is revoked and ErrTokenReused is returned. The refresh token
+// returned with it only holds the user and family IDs, so that the caller can revoke
+// anything issued for the family outside the database. An unknown or expired refresh
+// token returns ErrRecordNotFound.
+func (m TokenModel) Rotate(refreshPlaintext string, accessTTL, refreshTTL time.Duration, userAgent, ip string) (access, refresh *Token, err error) {
+	tokenHash := sha256.Sum256([]byte(refreshPlaintext))
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Lock the refresh token, so that two requests exchanging it at the same time are
+	// handled one after the other, and the second is treated as reuse.
+	query := `
+	SELECT user_id, family_id, used_at IS NOT NULL
+	FROM tokens
+	WHERE hash = $1 AND scope = $2 AND expiry > $3
+	FOR UPDATE`
+	var userID, familyID int64
+	var used bool
+	err = tx.QueryRowContext(ctx, query, tokenHash[:], ScopeRefresh, time.Now()).Scan(&userID, &familyID, &used)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	if used {
+		_, err = tx.ExecContext(ctx, "DELETE FROM tokens WHERE family_id = $1", familyID)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &Token{UserID: userID, FamilyID: familyID, Scope: ScopeRefresh}, ErrTokenReused
+	}
+	// Keep the used refresh token until it expires, rather than deleting it, so that
+	// reuse can be detected.
+	_, err = tx.ExecContext(ctx, "UPDATE tokens SET used_at = NOW(), last_used_at = NOW() WHERE hash = $1", tokenHash[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	access, refresh, err = issueSession(ctx, tx, userID, familyID, accessTTL, refreshTTL, userAgent, ip)
+	if err != nil {
+		return nil, nil, err
+	}
+	return access, refresh, tx.Commit()
 }
 
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
@@ -104,3 +250,118 @@ func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 	return err
 }
+
+// LastIssued returns the time that the user's most recent token with the given scope
+// was created, or the zero time if they don't have one.
+func (m TokenModel) LastIssued(scope string, userID int64) (time.Time, error) {
+	query := `
+	SELECT max(created_at)
+	FROM tokens
+	WHERE scope = $1 AND user_id = $2`
+	var createdAt sql.NullTime
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, scope, userID).Scan(&createdAt)
+	return createdAt.Time, err
+}
+
+// Touch records that a token has just been used, and returns its family ID. To avoid
+// writing to the tokens table on every request, last_used_at is only updated once it's
+// more than a minute old.
+func (m TokenModel) Touch(tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	query := `
+	WITH touched AS (
+		UPDATE tokens
+		SET last_used_at = NOW()
+		WHERE hash = $1
+		AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')
+		RETURNING family_id
+	)
+	SELECT family_id FROM touched
+	UNION ALL
+	SELECT family_id FROM tokens WHERE hash = $1
+	LIMIT 1`
+	var id int64
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:]).Scan(&id)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+	return id, nil
+}
+
+// GetSessionsForUser returns the user's sessions: the families of authentication and
+// refresh tokens which still have an unused, unexpired token, most recently used first.
+// A session's details come from its newest token, except that it was created with its
+// first token and last used with the most recently used one.
+func (m TokenModel) GetSessionsForUser(userID int64) ([]*Session, error) {
+	query := `
+	SELECT family_id, min(created_at), max(last_used_at),
+		max(expiry) FILTER (WHERE used_at IS NULL),
+		(array_agg(user_agent ORDER BY id DESC))[1],
+		(array_agg(ip ORDER BY id DESC))[1]
+	FROM tokens
+	WHERE user_id = $1 AND scope = ANY($2)
+	GROUP BY family_id
+	HAVING bool_or(used_at IS NULL AND expiry > $3)
+	ORDER BY COALESCE(max(last_used_at), min(created_at)) DESC, family_id DESC`
+	scopes := pq.Array([]string{ScopeAuthentication, ScopeRefresh})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	rows, err := m.DB.QueryContext(ctx, query, userID, scopes, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []*Session{}
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.UserAgent,
+			&session.IP,
+		)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// DeleteSession logs the user out of a session, by deleting every token in the family.
+// It returns ErrRecordNotFound if the user doesn't have a session with that ID, so that
+// users can't revoke each other's sessions.
+func (m TokenModel) DeleteSession(userID, familyID int64) error {
+	query := `
+	DELETE FROM tokens
+	WHERE user_id = $1 AND family_id = $2 AND scope = ANY($3)`
+	scopes := pq.Array([]string{ScopeAuthentication, ScopeRefresh})
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	result, err := m.DB.ExecContext(ctx, query, userID, familyID, scopes)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func mustDecode(t *testing.T, js string) interface{} {
+	t.Helper()
+	value, err := decode([]byte(js))
+	if err != nil {
+		t.Fatalf("decoding %s: %v", js, err)
+	}
+	return value
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		// wantIndex is the index of the operation that should fail, or -1 if the patch
+		// should apply.
+		wantIndex int
+	}{
+		{
+			name:      "Add object member",
+			doc:       `{"title":"Morgan dollar"}`,
+			patch:     `[{"op":"add","path":"/year","value":1921}]`,
+			want:      `{"title":"Morgan dollar","year":1921}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Add replaces existing member",
+			doc:       `{"year":1878}`,
+			patch:     `[{"op":"add","path":"/year","value":1921}]`,
+			want:      `{"year":1921}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Add array element",
+			doc:       `{"genres":["silver","dollar"]}`,
+			patch:     `[{"op":"add","path":"/genres/1","value":"us"}]`,
+			want:      `{"genres":["silver","us","dollar"]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Add to end of array",
+			doc:       `{"genres":["silver"]}`,
+			patch:     `[{"op":"add","path":"/genres/-","value":"dollar"}]`,
+			want:      `{"genres":["silver","dollar"]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Add null value",
+			doc:       `{}`,
+			patch:     `[{"op":"add","path":"/price","value":null}]`,
+			want:      `{"price":null}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Add whole document",
+			doc:       `{"a":1}`,
+			patch:     `[{"op":"add","path":"","value":{"b":2}}]`,
+			want:      `{"b":2}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Remove object member",
+			doc:       `{"title":"Morgan dollar","year":1921}`,
+			patch:     `[{"op":"remove","path":"/year"}]`,
+			want:      `{"title":"Morgan dollar"}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Remove array element",
+			doc:       `{"genres":["silver","us","dollar"]}`,
+			patch:     `[{"op":"remove","path":"/genres/1"}]`,
+			want:      `{"genres":["silver","dollar"]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Remove last array element",
+			doc:       `{"genres":["silver"]}`,
+			patch:     `[{"op":"remove","path":"/genres/0"}]`,
+			want:      `{"genres":[]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Replace nested value",
+			doc:       `{"price":{"amount":"10.00","currency":"USD"}}`,
+			patch:     `[{"op":"replace","path":"/price/amount","value":"12.50"}]`,
+			want:      `{"price":{"amount":"12.50","currency":"USD"}}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Replace array element",
+			doc:       `{"genres":["silver","dollar"]}`,
+			patch:     `[{"op":"replace","path":"/genres/0","value":"gold"}]`,
+			want:      `{"genres":["gold","dollar"]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Move member",
+			doc:       `{"legends":"E PLURIBUS UNUM","description":""}`,
+			patch:     `[{"op":"move","from":"/legends","path":"/description"}]`,
+			want:      `{"description":"E PLURIBUS UNUM"}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Move array element",
+			doc:       `{"genres":["a","b","c"]}`,
+			patch:     `[{"op":"move","from":"/genres/0","path":"/genres/-"}]`,
+			want:      `{"genres":["b","c","a"]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Copy value",
+			doc:       `{"price":{"amount":"10.00"}}`,
+			patch:     `[{"op":"copy","from":"/price","path":"/original_price"},{"op":"replace","path":"/price/amount","value":"11.00"}]`,
+			want:      `{"price":{"amount":"11.00"},"original_price":{"amount":"10.00"}}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Test passes",
+			doc:       `{"year":1921,"genres":["silver"]}`,
+			patch:     `[{"op":"test","path":"/year","value":1921.0},{"op":"test","path":"/genres","value":["silver"]}]`,
+			want:      `{"year":1921,"genres":["silver"]}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Escaped path",
+			doc:       `{"a/b":1,"m~n":2}`,
+			patch:     `[{"op":"replace","path":"/a~1b","value":3},{"op":"remove","path":"/m~0n"}]`,
+			want:      `{"a/b":3}`,
+			wantIndex: -1,
+		},
+		{
+			name:      "Test fails",
+			doc:       `{"year":1921}`,
+			patch:     `[{"op":"test","path":"/year","value":1921},{"op":"test","path":"/year","value":1878}]`,
+			wantIndex: 1,
+		},
+		{
+			name:      "Missing value",
+			doc:       `{}`,
+			patch:     `[{"op":"add","path":"/year"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Unknown operation",
+			doc:       `{}`,
+			patch:     `[{"op":"add","path":"/year","value":1},{"op":"increment","path":"/year"}]`,
+			wantIndex: 1,
+		},
+		{
+			name:      "Path without leading slash",
+			doc:       `{"year":1921}`,
+			patch:     `[{"op":"remove","path":"year"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Remove missing member",
+			doc:       `{"year":1921}`,
+			patch:     `[{"op":"remove","path":"/year"},{"op":"remove","path":"/year"}]`,
+			wantIndex: 1,
+		},
+		{
+			name:      "Replace missing member",
+			doc:       `{}`,
+			patch:     `[{"op":"replace","path":"/year","value":1921}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Add to missing parent",
+			doc:       `{}`,
+			patch:     `[{"op":"add","path":"/price/amount","value":"1.00"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Array index out of range",
+			doc:       `{"genres":["silver"]}`,
+			patch:     `[{"op":"add","path":"/genres/2","value":"dollar"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Array index with leading zero",
+			doc:       `{"genres":["silver","dollar"]}`,
+			patch:     `[{"op":"remove","path":"/genres/01"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Remove end of array",
+			doc:       `{"genres":["silver"]}`,
+			patch:     `[{"op":"remove","path":"/genres/-"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Move into own child",
+			doc:       `{"price":{"amount":"1.00"}}`,
+			patch:     `[{"op":"move","from":"/price","path":"/price/old"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Copy from missing path",
+			doc:       `{}`,
+			patch:     `[{"op":"copy","from":"/price","path":"/original_price"}]`,
+			wantIndex: 0,
+		},
+		{
+			name:      "Remove whole document",
+			doc:       `{}`,
+			patch:     `[{"op":"remove","path":""}]`,
+			wantIndex: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var operations []Operation
+			err := json.Unmarshal([]byte(tt.patch), &operations)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := Apply(mustDecode(t, tt.doc), operations)
+			if tt.wantIndex >= 0 {
+				var opErr *OperationError
+				if !errors.As(err, &opErr) {
+					t.Fatalf("got error %v; want an *OperationError", err)
+				}
+				if opErr.Index != tt.wantIndex {
+					t.Errorf("got failure at operation %d; want %d (%v)", opErr.Index, tt.wantIndex, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equal(got, mustDecode(t, tt.want)) {
+				t.Errorf("got %s; want %s", encode(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"Replace member", `{"title":"a","year":1}`, `{"title":"b"}`, `{"title":"b","year":1}`},
+		{"Remove member with null", `{"title":"a","genres":["x"]}`, `{"genres":null}`, `{"title":"a"}`},
+		{"Merge nested object", `{"price":{"amount":"1","currency":"USD"}}`, `{"price":{"amount":"2"}}`, `{"price":{"amount":"2","currency":"USD"}}`},
+		{"Replace array", `{"genres":["a","b"]}`, `{"genres":["c"]}`, `{"genres":["c"]}`},
+		{"Non-object patch", `{"a":1}`, `["x"]`, `["x"]`},
+		{"Object patch over non-object", `"x"`, `{"a":{"b":null}}`, `{"a":{}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := MergePatch(mustDecode(t, tt.doc), mustDecode(t, tt.patch))
+			if !equal(got, mustDecode(t, tt.want)) {
+				t.Errorf("got %s; want %s", encode(got), tt.want)
+			}
+		})
+	}
+}
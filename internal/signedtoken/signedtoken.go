@@ -0,0 +1,183 @@
+// Package signedtoken creates and verifies stateless authentication tokens. A token is
+// a JSON Web Token (RFC 7519) signed with Ed25519 (the "EdDSA" algorithm of RFC 8037),
+// so it can be verified without a database lookup.
+//
+// Each key is identified by a key ID, which is written in the token header. A Keyset
+// signs with one key and verifies with any of its keys, so keys can be rotated by adding
+// a new signing key and keeping the old one for verification until the tokens signed
+// with it have expired.
+package signedtoken
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidToken is returned for a token which is malformed, signed with an
+	// unknown key or has a bad signature.
+	ErrInvalidToken = errors.New("invalid signed token")
+	// ErrExpiredToken is returned for a valid token which has expired.
+	ErrExpiredToken = errors.New("signed token has expired")
+)
+
+// Claims are the contents of a token. The subject is the user ID, as a string, and the
+// session ID is the ID of the token family that the token was issued from.
+type Claims struct {
+	Subject     string   `json:"sub"`
+	SessionID   int64    `json:"sid,omitempty"`
+	Activated   bool     `json:"act"`
+	Permissions []string `json:"perms"`
+	IssuedAt    int64    `json:"iat"`
+	Expiry      int64    `json:"exp"`
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ"`
+	KeyID     string `json:"kid"`
+}
+
+// Keyset holds the key that new tokens are signed with, and every key that tokens can
+// be verified with, by key ID.
+type Keyset struct {
+	signingKeyID string
+	signingKey   ed25519.PrivateKey
+	keys         map[string]ed25519.PublicKey
+}
+
+// LoadKeyset reads Ed25519 keys from PEM files, like those created by
+// "openssl genpkey -algorithm ed25519". The first file must hold a private key, which
+// new tokens are signed with. The rest can hold private or public keys, and are only
+// used to verify tokens. Each key's ID is its file name without the extension.
+func LoadKeyset(paths []string) (*Keyset, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no signing keys given")
+	}
+	ks := &Keyset{keys: make(map[string]ed25519.PublicKey)}
+	for i, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		if _, ok := ks.keys[kid]; ok {
+			return nil, fmt.Errorf("duplicate key ID %q", kid)
+		}
+		private, public, err := readKey(path)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			if private == nil {
+				return nil, fmt.Errorf("%s: the first key must be a private key", path)
+			}
+			ks.signingKeyID, ks.signingKey = kid, private
+		}
+		ks.keys[kid] = public
+	}
+	return ks, nil
+}
+
+// readKey reads one PEM-encoded key. For a private key it returns both halves, and for
+// a public key it returns a nil private key.
+func readKey(path string) (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		private, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: not an Ed25519 key", path)
+		}
+		return private, private.Public().(ed25519.PublicKey), nil
+	case "PUBLIC KEY":
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		public, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return nil, nil, fmt.Errorf("%s: not an Ed25519 key", path)
+		}
+		return nil, public, nil
+	default:
+		return nil, nil, fmt.Errorf("%s: unsupported PEM block type %q", path, block.Type)
+	}
+}
+
+var encoding = base64.RawURLEncoding
+
+// Sign returns a token holding the claims, signed with the keyset's signing key.
+func (ks *Keyset) Sign(claims Claims) (string, error) {
+	h, err := json.Marshal(header{Algorithm: "EdDSA", Type: "JWT", KeyID: ks.signingKeyID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := encoding.EncodeToString(h) + "." + encoding.EncodeToString(payload)
+	signature := ed25519.Sign(ks.signingKey, []byte(signingInput))
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
+
+// Verify checks the token's signature and expiry, and returns its claims.
+func (ks *Keyset) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+	var h header
+	err := decodePart(parts[0], &h)
+	if err != nil || h.Algorithm != "EdDSA" {
+		return nil, ErrInvalidToken
+	}
+	key, ok := ks.keys[h.KeyID]
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	err = decodePart(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if now.Unix() >= claims.Expiry {
+		return nil, ErrExpiredToken
+	}
+	return &claims, nil
+}
+
+func decodePart(part string, dst interface{}) error {
+	js, err := encoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(js, dst)
+}
+
+// LooksSigned reports whether a bearer token has the three dot-separated parts of a
+// signed token, as opposed to the opaque tokens stored in the database.
+func LooksSigned(token string) bool {
+	return strings.Count(token, ".") == 2
+}
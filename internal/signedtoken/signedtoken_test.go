@@ -0,0 +1,247 @@
+package signedtoken
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeKey generates an Ed25519 key and writes its private half to <dir>/<kid>.pem and
+// its public half to <dir>/<kid>.pub, returning both paths.
+func writeKey(t *testing.T, dir, kid string) (privatePath, publicPath string) {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath = filepath.Join(dir, kid+".pem")
+	publicPath = filepath.Join(dir, kid+".pub")
+	for path, block := range map[string]*pem.Block{
+		privatePath: {Type: "PRIVATE KEY", Bytes: privateDER},
+		publicPath:  {Type: "PUBLIC KEY", Bytes: publicDER},
+	} {
+		err = os.WriteFile(path, pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return privatePath, publicPath
+}
+
+func mustLoad(t *testing.T, paths ...string) *Keyset {
+	t.Helper()
+	ks, err := LoadKeyset(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func mustSign(t *testing.T, ks *Keyset, claims Claims) string {
+	t.Helper()
+	token, err := ks.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+var now = time.Unix(1_700_000_000, 0)
+
+func testClaims() Claims {
+	return Claims{
+		Subject:     "42",
+		SessionID:   7,
+		Activated:   true,
+		Permissions: []string{"coins:read", "coins:write"},
+		IssuedAt:    now.Unix(),
+		Expiry:      now.Add(15 * time.Minute).Unix(),
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	k1, _ := writeKey(t, t.TempDir(), "k1")
+	ks := mustLoad(t, k1)
+	want := testClaims()
+	token := mustSign(t, ks, want)
+
+	if !LooksSigned(token) {
+		t.Errorf("LooksSigned(%q) = false; want true", token)
+	}
+
+	got, err := ks.Verify(token, now)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	gotJS, _ := json.Marshal(got)
+	wantJS, _ := json.Marshal(want)
+	if string(gotJS) != string(wantJS) {
+		t.Errorf("got claims %s; want %s", gotJS, wantJS)
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	k1, _ := writeKey(t, t.TempDir(), "k1")
+	ks := mustLoad(t, k1)
+	token := mustSign(t, ks, testClaims())
+
+	tests := []struct {
+		name    string
+		now     time.Time
+		wantErr error
+	}{
+		{"Before expiry", now.Add(15*time.Minute - time.Second), nil},
+		{"At expiry", now.Add(15 * time.Minute), ErrExpiredToken},
+		{"After expiry", now.Add(time.Hour), ErrExpiredToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(token, tt.now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v; want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// replacePart returns the token with one of its three dot-separated parts replaced.
+func replacePart(token string, i int, part string) string {
+	parts := strings.Split(token, ".")
+	parts[i] = part
+	return strings.Join(parts, ".")
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	dir := t.TempDir()
+	k1, _ := writeKey(t, dir, "k1")
+	k2, _ := writeKey(t, dir, "k2")
+	ks := mustLoad(t, k1)
+	token := mustSign(t, ks, testClaims())
+	parts := strings.Split(token, ".")
+
+	tampered := testClaims()
+	tampered.Permissions = append(tampered.Permissions, "users:admin")
+	tamperedPayload, _ := json.Marshal(tampered)
+
+	signature, _ := encoding.DecodeString(parts[2])
+	signature[0] ^= 0xff
+
+	header := func(alg, kid string) string {
+		js, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+		return encoding.EncodeToString(js)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Empty", ""},
+		{"Two parts", parts[0] + "." + parts[1]},
+		{"Four parts", token + ".x"},
+		{"Unknown key ID", mustSign(t, mustLoad(t, k2), testClaims())},
+		{"Algorithm none", replacePart(token, 0, header("none", "k1"))},
+		{"Algorithm HS256", replacePart(token, 0, header("HS256", "k1"))},
+		{"Empty signature for alg none", replacePart(replacePart(token, 0, header("none", "k1")), 2, "")},
+		{"Tampered payload", replacePart(token, 1, encoding.EncodeToString(tamperedPayload))},
+		{"Tampered signature", replacePart(token, 2, encoding.EncodeToString(signature))},
+		{"Signature not base64", replacePart(token, 2, "!!!")},
+		{"Header not JSON", replacePart(token, 0, encoding.EncodeToString([]byte("not json")))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ks.Verify(tt.token, now)
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("got error %v; want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	k1, k1Public := writeKey(t, dir, "k1")
+	k2, _ := writeKey(t, dir, "k2")
+
+	before := mustLoad(t, k1)
+	oldToken := mustSign(t, before, testClaims())
+
+	// After rotating, k2 signs and the old key is only kept, as a public key, to verify
+	// the tokens that it signed.
+	after := mustLoad(t, k2, k1Public)
+	newToken := mustSign(t, after, testClaims())
+
+	for name, token := range map[string]string{"Old token": oldToken, "New token": newToken} {
+		_, err := after.Verify(token, now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+	}
+
+	var h header
+	err := decodePart(strings.Split(newToken, ".")[0], &h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.KeyID != "k2" {
+		t.Errorf("got key ID %q for a new token; want %q", h.KeyID, "k2")
+	}
+
+	// An instance that hasn't been given the new key yet can't verify the new tokens.
+	_, err = before.Verify(newToken, now)
+	if !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("got error %v verifying a new token with the old keyset; want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestLoadKeyset(t *testing.T) {
+	dir := t.TempDir()
+	k1, k1Public := writeKey(t, dir, "k1")
+	k2, _ := writeKey(t, dir, "k2")
+	notPEM := filepath.Join(dir, "k3.pem")
+	err := os.WriteFile(notPEM, []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		paths   []string
+		wantErr bool
+	}{
+		{"Private key", []string{k1}, false},
+		{"Private and public keys", []string{k2, k1Public}, false},
+		{"Private keys", []string{k2, k1}, false},
+		{"No keys", nil, true},
+		{"Public key first", []string{k1Public, k2}, true},
+		{"Duplicate key ID", []string{k1, k1Public}, true},
+		{"Missing file", []string{filepath.Join(dir, "missing.pem")}, true},
+		{"Not PEM", []string{notPEM}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := LoadKeyset(tt.paths)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v; want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
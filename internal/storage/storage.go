@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound         = errors.New("object not found")
+	ErrInvalidKey       = errors.New("invalid object key")
+	ErrInvalidSignature = errors.New("invalid or expired signature")
+)
+
+// Store is implemented by anything that can hold binary objects (images, certificates,
+// exports and so on) under a slash-separated key, like "coins/1/obverse.jpg".
+type Store interface {
+	// Put writes the contents of r to the object with the given key, replacing any
+	// existing object.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Get opens the object with the given key for reading. The caller must close the
+	// returned ReadCloser. If the object doesn't exist, ErrNotFound is returned.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes the object with the given key. Deleting an object that doesn't
+	// exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL that allows anyone holding it to download the object
+	// until the ttl has passed, without any other credentials.
+	SignedURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+// URLVerifier is implemented by stores whose signed URLs point back at this
+// application, rather than at the storage backend itself. VerifySignedURL checks the
+// query string of a request for the object with the given key.
+type URLVerifier interface {
+	VerifySignedURL(key string, query url.Values) error
+}
+
+// ValidKey reports whether a key is safe to use with any Store: it must be a clean,
+// relative, slash-separated path that doesn't escape its root.
+func ValidKey(key string) bool {
+	if key == "" || len(key) > 1024 || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+	if path.Clean(key) != key {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." || part == "." {
+			return false
+		}
+	}
+	return true
+}
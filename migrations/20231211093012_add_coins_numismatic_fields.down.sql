@@ -0,0 +1,19 @@
+DROP INDEX IF EXISTS coins_country_idx;
+
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_face_value_check;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_weight_check;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_diameter_check;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_mintage_check;
+
+ALTER TABLE coins
+DROP COLUMN IF EXISTS country,
+DROP COLUMN IF EXISTS denomination,
+DROP COLUMN IF EXISTS face_value,
+DROP COLUMN IF EXISTS composition,
+DROP COLUMN IF EXISTS weight,
+DROP COLUMN IF EXISTS diameter,
+DROP COLUMN IF EXISTS mint,
+DROP COLUMN IF EXISTS mintage,
+DROP COLUMN IF EXISTS catalogue_refs;
+ALTER TABLE coins ALTER COLUMN price DROP DEFAULT;
+ALTER TABLE coins DROP COLUMN IF EXISTS version;
@@ -0,0 +1,19 @@
+ALTER TABLE coins ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
+ALTER TABLE coins ALTER COLUMN price SET DEFAULT 0;
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS country text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS denomination text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS face_value numeric(14, 4) NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS composition text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS weight numeric(10, 3) NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS diameter numeric(8, 2) NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS mint text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS mintage bigint NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS catalogue_refs text[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE coins ADD CONSTRAINT coins_face_value_check CHECK (face_value >= 0);
+ALTER TABLE coins ADD CONSTRAINT coins_weight_check CHECK (weight >= 0);
+ALTER TABLE coins ADD CONSTRAINT coins_diameter_check CHECK (diameter >= 0);
+ALTER TABLE coins ADD CONSTRAINT coins_mintage_check CHECK (mintage >= 0);
+
+CREATE INDEX IF NOT EXISTS coins_country_idx ON coins (country);
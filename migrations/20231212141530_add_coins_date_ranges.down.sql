@@ -0,0 +1,14 @@
+DROP INDEX IF EXISTS coins_year_range_idx;
+
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_year_provided_check;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_year_range_check;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_year_check;
+
+ALTER TABLE coins
+DROP COLUMN IF EXISTS year_start,
+DROP COLUMN IF EXISTS year_end,
+DROP COLUMN IF EXISTS year_from,
+DROP COLUMN IF EXISTS year_to,
+DROP COLUMN IF EXISTS era;
+ALTER TABLE coins ALTER COLUMN year DROP DEFAULT;
+ALTER TABLE coins ADD CONSTRAINT coins_coins_check CHECK (year BETWEEN 1888 AND date_part('year', now()));
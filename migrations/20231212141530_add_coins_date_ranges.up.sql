@@ -0,0 +1,18 @@
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_coins_check;
+ALTER TABLE coins ALTER COLUMN year SET DEFAULT 0;
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS year_from integer NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS year_to integer NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS era text NOT NULL DEFAULT '';
+
+-- The effective start and end of each coin's date range, used for filtering and
+-- sorting. Exactly dated coins have a range of a single year.
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS year_start integer GENERATED ALWAYS AS (CASE WHEN year_from <> 0 THEN year_from ELSE year END) STORED,
+ADD COLUMN IF NOT EXISTS year_end integer GENERATED ALWAYS AS (CASE WHEN year_to <> 0 THEN year_to ELSE year END) STORED;
+
+ALTER TABLE coins ADD CONSTRAINT coins_year_provided_check CHECK (year <> 0 OR (year_from <> 0 AND year_to <> 0));
+ALTER TABLE coins ADD CONSTRAINT coins_year_range_check CHECK (year_from <= year_to);
+ALTER TABLE coins ADD CONSTRAINT coins_year_check CHECK (year_start >= -1000 AND year_end <= date_part('year', now()));
+
+CREATE INDEX IF NOT EXISTS coins_year_range_idx ON coins (year_start, year_end);
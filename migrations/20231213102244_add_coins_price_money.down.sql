@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS coins_price_idx;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_price_check;
+ALTER TABLE coins ALTER COLUMN price TYPE integer USING COALESCE((price).amount / 100, 0)::integer;
+ALTER TABLE coins ALTER COLUMN price SET DEFAULT 0;
+ALTER TABLE coins ALTER COLUMN price SET NOT NULL;
+DROP TYPE IF EXISTS money_amount;
@@ -0,0 +1,15 @@
+CREATE TYPE money_amount AS (
+amount bigint,
+currency char(3)
+);
+
+-- The old integer price column had no currency. Existing values are assumed to be whole
+-- US dollars and are converted to cents.
+ALTER TABLE coins ALTER COLUMN price DROP DEFAULT;
+ALTER TABLE coins ALTER COLUMN price DROP NOT NULL;
+ALTER TABLE coins ALTER COLUMN price TYPE money_amount
+USING CASE WHEN price > 0 THEN ROW(price::bigint * 100, 'USD')::money_amount END;
+
+ALTER TABLE coins ADD CONSTRAINT coins_price_check CHECK (price IS NULL OR ((price).amount >= 0 AND (price).currency IS NOT NULL));
+
+CREATE INDEX IF NOT EXISTS coins_price_idx ON coins (((price).currency), ((price).amount));
@@ -0,0 +1,3 @@
+DELETE FROM permissions WHERE code = 'rates:write';
+DROP TABLE IF EXISTS rates;
+DROP TABLE IF EXISTS rate_snapshots;
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS rate_snapshots (
+id bigserial PRIMARY KEY,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+source text NOT NULL,
+base char(3) NOT NULL
+);
+CREATE TABLE IF NOT EXISTS rates (
+snapshot_id bigint NOT NULL REFERENCES rate_snapshots ON DELETE CASCADE,
+currency char(3) NOT NULL,
+rate numeric(24, 10) NOT NULL CHECK (rate > 0),
+PRIMARY KEY (snapshot_id, currency)
+);
+INSERT INTO permissions (code)
+VALUES
+('rates:write');
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS coin_prices;
+ALTER TABLE coins DROP COLUMN IF EXISTS price_source;
@@ -0,0 +1,15 @@
+ALTER TABLE coins ADD COLUMN IF NOT EXISTS price_source text NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS coin_prices (
+id bigserial PRIMARY KEY,
+coin_id bigint NOT NULL REFERENCES coins ON DELETE CASCADE,
+price money_amount NOT NULL,
+source text NOT NULL CHECK (source IN ('dealer_quote', 'auction_result', 'manual')),
+recorded_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS coin_prices_coin_id_recorded_at_idx ON coin_prices (coin_id, recorded_at);
+
+-- Seed the history with the current price of every coin that has one.
+UPDATE coins SET price_source = 'manual' WHERE price IS NOT NULL;
+INSERT INTO coin_prices (coin_id, price, source, recorded_at)
+SELECT id, price, 'manual', created_at FROM coins WHERE price IS NOT NULL;
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS coins_grade_number_idx;
+DROP INDEX IF EXISTS coins_grading_service_cert_number_key;
+ALTER TABLE coins DROP CONSTRAINT IF EXISTS coins_grade_number_check;
+ALTER TABLE coins
+DROP COLUMN IF EXISTS grade_number,
+DROP COLUMN IF EXISTS grade,
+DROP COLUMN IF EXISTS grading_service,
+DROP COLUMN IF EXISTS cert_number,
+DROP COLUMN IF EXISTS designations;
@@ -0,0 +1,16 @@
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS grade text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS grading_service text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS cert_number text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS designations text[] NOT NULL DEFAULT '{}';
+
+-- The numeric part of the Sheldon grade (0 for ungraded coins), used for filtering and
+-- sorting.
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS grade_number smallint GENERATED ALWAYS AS (COALESCE(substring(grade FROM '-([0-9]+)$')::smallint, 0)) STORED;
+
+ALTER TABLE coins ADD CONSTRAINT coins_grade_number_check CHECK (grade_number BETWEEN 0 AND 70);
+
+-- A certified slab can only be registered against one coin.
+CREATE UNIQUE INDEX IF NOT EXISTS coins_grading_service_cert_number_key ON coins (grading_service, cert_number) WHERE cert_number <> '';
+CREATE INDEX IF NOT EXISTS coins_grade_number_idx ON coins (grade_number);
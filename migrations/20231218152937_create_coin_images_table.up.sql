@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS coin_images (
+id bigserial PRIMARY KEY,
+coin_id bigint NOT NULL REFERENCES coins ON DELETE CASCADE,
+created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+side text NOT NULL CHECK (side IN ('obverse', 'reverse', 'edge', 'slab')),
+content_type text NOT NULL,
+size bigint NOT NULL CHECK (size > 0),
+width integer NOT NULL,
+height integer NOT NULL,
+key text UNIQUE NOT NULL,
+thumbnail_key text UNIQUE NOT NULL
+);
+CREATE INDEX IF NOT EXISTS coin_images_coin_id_idx ON coin_images (coin_id);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS coins_search_vector_idx;
+ALTER TABLE coins
+DROP COLUMN IF EXISTS search_vector,
+DROP COLUMN IF EXISTS legends,
+DROP COLUMN IF EXISTS description;
@@ -0,0 +1,15 @@
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS legends text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '';
+
+-- A weighted search vector: matches in the title rank highest, followed by the legends,
+-- the issuing country and finally the description.
+ALTER TABLE coins
+ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+setweight(to_tsvector('simple', title), 'A') ||
+setweight(to_tsvector('simple', legends), 'B') ||
+setweight(to_tsvector('simple', country), 'C') ||
+setweight(to_tsvector('simple', description), 'D')
+) STORED;
+
+CREATE INDEX IF NOT EXISTS coins_search_vector_idx ON coins USING GIN (search_vector);
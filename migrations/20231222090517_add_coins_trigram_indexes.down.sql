@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS coins_legends_trgm_idx;
+DROP INDEX IF EXISTS coins_title_trgm_idx;
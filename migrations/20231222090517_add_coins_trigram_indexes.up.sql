@@ -0,0 +1,4 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE INDEX IF NOT EXISTS coins_title_trgm_idx ON coins USING GIN (title gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS coins_legends_trgm_idx ON coins USING GIN (legends gin_trgm_ops);
@@ -0,0 +1,5 @@
+CREATE SEQUENCE IF NOT EXISTS tokens_family_id_seq;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id bigint NOT NULL DEFAULT nextval('tokens_family_id_seq');
+ALTER SEQUENCE tokens_family_id_seq OWNED BY tokens.family_id;
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used_at timestamp(0) with time zone;
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id);